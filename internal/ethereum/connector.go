@@ -0,0 +1,74 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hyperledger/firefly-common/pkg/config"
+	"github.com/hyperledger/firefly-common/pkg/fftypes"
+	"github.com/hyperledger/firefly-common/pkg/i18n"
+	"github.com/hyperledger/firefly-evmconnect/internal/jsonrpc"
+	"github.com/hyperledger/firefly-evmconnect/internal/msgs"
+)
+
+// ethConnector is the event-stream facing half of the ethereum connector: the registry of
+// running streams (EventStreamStart/EventStreamStopped) plus the JSON-RPC backend and
+// delivery config every stream it creates shares.
+type ethConnector struct {
+	backend               jsonrpc.Client
+	deliveryMode          deliveryMode
+	maxListenersPerFilter int
+
+	streamsMux sync.Mutex
+	streams    map[fftypes.UUID]*eventStream
+}
+
+// newEthConnector constructs the event-stream connector against a JSON-RPC backend -
+// jsonrpc.NewHTTPClient for a plain node, or jsonrpc.DialWSClient for one that should use
+// eth_subscribe push delivery where possible.
+func newEthConnector(backend jsonrpc.Client, section config.Section) *ethConnector {
+	maxListenersPerFilter := defaultMaxListenersPerFilter
+	mode := deliveryModeAuto
+	if section != nil {
+		if v := section.GetInt(ConfigEventsMaxListenersPerFilter); v > 0 {
+			maxListenersPerFilter = v
+		}
+		if v := section.GetString(ConfigEventsDeliveryMode); v != "" {
+			mode = deliveryMode(v)
+		}
+	}
+	return &ethConnector{
+		backend:               backend,
+		deliveryMode:          mode,
+		maxListenersPerFilter: maxListenersPerFilter,
+		streams:               make(map[fftypes.UUID]*eventStream),
+	}
+}
+
+// getStream looks up a running stream, reporting the same "not found" error whether the
+// stream ID is unknown or was never started - callers cannot distinguish the two cases
+func (c *ethConnector) getStream(ctx context.Context, streamID *fftypes.UUID) (*eventStream, error) {
+	c.streamsMux.Lock()
+	defer c.streamsMux.Unlock()
+	s := c.streams[*streamID]
+	if s == nil {
+		return nil, i18n.NewError(ctx, msgs.MsgStreamOrListenerNotFound, streamID)
+	}
+	return s, nil
+}
@@ -0,0 +1,33 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperledger/firefly-evmconnect/mocks/jsonrpcmocks"
+)
+
+// newTestConnector builds an ethConnector against a mock jsonrpc.Client, for event_actions_test.go
+// and friends to exercise EventStreamStart/EventListenerAdd/... without a real node.
+func newTestConnector(t *testing.T) (context.Context, func(), *ethConnector, *jsonrpcmocks.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mRPC := &jsonrpcmocks.Client{}
+	c := newEthConnector(mRPC, nil)
+	return ctx, cancel, c, mRPC
+}
@@ -0,0 +1,206 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+
+	"github.com/hyperledger/firefly-common/pkg/fftypes"
+	"github.com/hyperledger/firefly-common/pkg/i18n"
+	"github.com/hyperledger/firefly-evmconnect/internal/msgs"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+)
+
+// EventStreamStart registers and starts a new event stream. The InitialListeners entries are
+// validated and added one at a time, and the stream is recorded as started only once all of
+// them have been added, so a single bad listener fails the whole call. Filters and
+// subscriptions already set up for the entries before it are not removed, and the push
+// subscriber started for the stream runs until req.StreamContext is cancelled. The background
+// eth_getFilterChanges poll loop (and, when available, the eth_subscribe push path) run until
+// req.StreamContext is cancelled.
+func (c *ethConnector) EventStreamStart(ctx context.Context, req *ffcapi.EventStreamStartRequest) (*ffcapi.EventStreamStartResponse, ffcapi.ErrorReason, error) {
+	c.streamsMux.Lock()
+	if _, exists := c.streams[*req.ID]; exists {
+		c.streamsMux.Unlock()
+		return nil, ffcapi.ErrorReasonInvalidInputs, i18n.NewError(ctx, msgs.MsgStreamAlreadyStarted, req.ID)
+	}
+	c.streamsMux.Unlock()
+
+	sink, err := newEventSink(ctx, req.EventStream, nil)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+
+	s := newEventStream(req.ID, req.StreamContext, c.backend, c.maxListenersPerFilter, c.deliveryMode, sink, req.BlockListener)
+	if err := s.subscriber.start(req.StreamContext); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+
+	for _, l := range req.InitialListeners {
+		if err := s.addListener(ctx, l); err != nil {
+			return nil, ffcapi.ErrorReasonInvalidInputs, err
+		}
+	}
+
+	c.streamsMux.Lock()
+	c.streams[*req.ID] = s
+	c.streamsMux.Unlock()
+
+	s.startPolling()
+
+	return &ffcapi.EventStreamStartResponse{}, "", nil
+}
+
+// EventStreamStartInternalRequest is the input to EventStreamStartInternal, the
+// InternalDispatcher-driven equivalent of EventStreamStart, for embedding this connector
+// as a library: EventStreamStartInternal hands decoded events to an in-process
+// callback, batched with synchronous back-pressure, instead of requiring the caller to
+// stand up an ffcapi.ListenerEvent channel. ffcapi.EventStreamStartRequest has no dispatcher
+// field of its own, so this is a connector-specific entry point alongside it rather than an
+// alternate code path through it.
+type EventStreamStartInternalRequest struct {
+	ID               *fftypes.UUID
+	InitialListeners []*ffcapi.EventListenerAddRequest
+	StreamContext    context.Context
+	InternalDispatcher
+	BlockListener chan<- *ffcapi.BlockHashEvent
+}
+
+func (c *ethConnector) EventStreamStartInternal(ctx context.Context, req *EventStreamStartInternalRequest) (*ffcapi.EventStreamStartResponse, ffcapi.ErrorReason, error) {
+	c.streamsMux.Lock()
+	if _, exists := c.streams[*req.ID]; exists {
+		c.streamsMux.Unlock()
+		return nil, ffcapi.ErrorReasonInvalidInputs, i18n.NewError(ctx, msgs.MsgStreamAlreadyStarted, req.ID)
+	}
+	c.streamsMux.Unlock()
+
+	sink, err := newEventSink(ctx, nil, req.InternalDispatcher)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+
+	s := newEventStream(req.ID, req.StreamContext, c.backend, c.maxListenersPerFilter, c.deliveryMode, sink, req.BlockListener)
+	if err := s.subscriber.start(req.StreamContext); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+
+	for _, l := range req.InitialListeners {
+		if err := s.addListener(ctx, l); err != nil {
+			return nil, ffcapi.ErrorReasonInvalidInputs, err
+		}
+	}
+
+	c.streamsMux.Lock()
+	c.streams[*req.ID] = s
+	c.streamsMux.Unlock()
+
+	s.startPolling()
+
+	return &ffcapi.EventStreamStartResponse{}, "", nil
+}
+
+// EventStreamStopped reports an error until the caller has cancelled StreamContext - only
+// then is it safe to drop the stream's bookkeeping, since the poll loop and push subscriber
+// both key their shutdown off that same context.
+func (c *ethConnector) EventStreamStopped(ctx context.Context, req *ffcapi.EventStreamStoppedRequest) (*ffcapi.EventStreamStoppedResponse, ffcapi.ErrorReason, error) {
+	s, err := c.getStream(ctx, req.ID)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	if s.ctx.Err() == nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, i18n.NewError(ctx, msgs.MsgStreamStillRunning, req.ID)
+	}
+
+	c.streamsMux.Lock()
+	delete(c.streams, *req.ID)
+	c.streamsMux.Unlock()
+
+	return &ffcapi.EventStreamStoppedResponse{}, "", nil
+}
+
+// EventListenerAdd registers a new listener against an already-running stream
+func (c *ethConnector) EventListenerAdd(ctx context.Context, req *ffcapi.EventListenerAddRequest) (*ffcapi.EventListenerAddResponse, ffcapi.ErrorReason, error) {
+	s, err := c.getStream(ctx, req.StreamID)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	if err := s.addListener(ctx, req); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	return &ffcapi.EventListenerAddResponse{}, "", nil
+}
+
+// EventListenerRemove tears down a listener's filter membership, push subscription and
+// reorg-tracking state on an already-running stream
+func (c *ethConnector) EventListenerRemove(ctx context.Context, req *ffcapi.EventListenerRemoveRequest) (*ffcapi.EventListenerRemoveResponse, ffcapi.ErrorReason, error) {
+	s, err := c.getStream(ctx, req.StreamID)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	if err := s.removeListener(ctx, req.ListenerID); err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	return &ffcapi.EventListenerRemoveResponse{}, "", nil
+}
+
+// EventListenerHWM reports the listener's delivered high-water mark - the latest log it
+// has pushed to the stream, rewound to the preceding delivered log when a reorg revokes
+// one - falling back to the listener's original resume checkpoint while no delivered log
+// remains (before the first delivery, or after a revoke has rewound past all retained ones).
+func (c *ethConnector) EventListenerHWM(ctx context.Context, req *ffcapi.EventListenerHWMRequest) (*ffcapi.EventListenerHWMResponse, ffcapi.ErrorReason, error) {
+	s, err := c.getStream(ctx, req.StreamID)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	l := s.getListener(req.ListenerID)
+	if l == nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, i18n.NewError(ctx, msgs.MsgStreamOrListenerNotFound, req.ListenerID)
+	}
+
+	delivered, _ := s.reorg.HWM(l.id)
+	if delivered == nil {
+		delivered = l.checkpoint
+	}
+	return &ffcapi.EventListenerHWMResponse{Checkpoint: delivered}, "", nil
+}
+
+// EventListenerVerifyOptions resolves and validates a listener's Filters/Options ahead of
+// EventStreamStart/EventListenerAdd, reporting the resolved signature (address and event
+// signature) and the resolved options those calls would use, without registering anything.
+func (c *ethConnector) EventListenerVerifyOptions(ctx context.Context, req *ffcapi.EventListenerVerifyOptionsRequest) (*ffcapi.EventListenerVerifyOptionsResponse, ffcapi.ErrorReason, error) {
+	resolved, err := parseListenerOptions(ctx, &req.EventListenerOptions, msgs.MsgInvalidFilter)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	return &ffcapi.EventListenerVerifyOptionsResponse{
+		ResolvedSignature: resolved.resolvedSignature,
+		ResolvedOptions:   fftypes.JSONAny(resolved.resolvedOptions),
+	}, "", nil
+}
+
+// EventStreamNewCheckpointStruct returns the concrete checkpoint type this connector
+// persists and resumes from - the type callers must pass back in on EventListenerAddRequest.Checkpoint
+func (c *ethConnector) EventStreamNewCheckpointStruct() ffcapi.EventListenerCheckpoint {
+	return &listenerCheckpoint{}
+}
+
+// EventListenerReplay runs a bounded, one-shot eth_getLogs query against the live backend -
+// the synchronous counterpart to EventStreamStart's persistent listener, registering nothing
+// and advancing no checkpoint.
+func (c *ethConnector) EventListenerReplay(ctx context.Context, req *EventListenerReplayRequest) (*EventListenerReplayResponse, ffcapi.ErrorReason, error) {
+	return newEventReplayer(c.backend).Replay(ctx, req)
+}
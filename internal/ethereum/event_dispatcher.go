@@ -0,0 +1,101 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+
+	"github.com/hyperledger/firefly-common/pkg/i18n"
+	"github.com/hyperledger/firefly-evmconnect/internal/msgs"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+)
+
+// InternalDispatcher receives batches of decoded events directly, in-process, as an
+// alternative to the unbuffered ffcapi.ListenerEvent channel that EventStreamStart
+// otherwise requires. It mirrors the EventStreamTypeInternal dispatch mode added to
+// firefly-transaction-manager: an application embedding this connector as a library can
+// take events as direct callbacks instead of standing up the FFTM channel plumbing.
+//
+// A non-nil error keeps the batch held in the stream's sink for redelivery on the next
+// flush, and the polling loop fetches no new filter changes until that redelivery
+// succeeds, matching how a blocked channel send already back-pressures the poller.
+type InternalDispatcher func(ctx context.Context, events []*ffcapi.ListenerEvent) error
+
+// defaultDispatchBatchSize caps how many events are buffered before being flushed to the
+// dispatcher as one batch
+const defaultDispatchBatchSize = 100
+
+// eventSink abstracts the two ways decoded events leave the stream loop - the existing
+// EventStream channel, or an InternalDispatcher - so the rest of the stream code does not
+// need to care which one a given stream was started with.
+type eventSink struct {
+	channel    chan<- *ffcapi.ListenerEvent
+	dispatcher InternalDispatcher
+	batchSize  int
+	batch      []*ffcapi.ListenerEvent
+}
+
+// newEventSink validates that exactly one of channel/dispatcher is set, as required by
+// EventStreamStart, and returns the sink the stream loop should deliver events through.
+func newEventSink(ctx context.Context, channel chan<- *ffcapi.ListenerEvent, dispatcher InternalDispatcher) (*eventSink, error) {
+	if (channel == nil) == (dispatcher == nil) {
+		return nil, i18n.NewError(ctx, msgs.MsgDispatchModeInvalid)
+	}
+	return &eventSink{
+		channel:    channel,
+		dispatcher: dispatcher,
+		batchSize:  defaultDispatchBatchSize,
+	}, nil
+}
+
+// Push queues a single decoded event. On the dispatcher path it only flushes once
+// batchSize events have accumulated; call Flush to force delivery of a partial batch
+// (e.g. at the end of a poll cycle, so events are not held back waiting to fill a batch).
+func (s *eventSink) Push(ctx context.Context, event *ffcapi.ListenerEvent) error {
+	if s.dispatcher == nil {
+		select {
+		case s.channel <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.batch = append(s.batch, event)
+	if len(s.batch) >= s.batchSize {
+		return s.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush hands any buffered batch to the dispatcher synchronously, blocking the caller -
+// the stream's poller - until the dispatcher returns. A nil return acknowledges the batch;
+// on an error the batch is kept and the error is returned, so the next Flush retries it.
+// It is a no-op on the channel path, and a no-op with an empty batch.
+func (s *eventSink) Flush(ctx context.Context) error {
+	if s.dispatcher == nil || len(s.batch) == 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch = nil
+	if err := s.dispatcher(ctx, batch); err != nil {
+		// keep the undelivered batch so the next Flush retries it, giving the dispatcher
+		// path the same "nothing is lost while blocked" guarantee as a blocked channel send
+		s.batch = batch
+		return err
+	}
+	return nil
+}
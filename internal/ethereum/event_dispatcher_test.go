@@ -0,0 +1,108 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewEventSinkRejectsNeitherSet(t *testing.T) {
+	_, err := newEventSink(context.Background(), nil, nil)
+	assert.Regexp(t, "FF23056", err)
+}
+
+func TestNewEventSinkRejectsBothSet(t *testing.T) {
+	ch := make(chan *ffcapi.ListenerEvent, 1)
+	_, err := newEventSink(context.Background(), ch, func(ctx context.Context, events []*ffcapi.ListenerEvent) error { return nil })
+	assert.Regexp(t, "FF23056", err)
+}
+
+func TestEventSinkChannelPushDeliversToChannel(t *testing.T) {
+	ch := make(chan *ffcapi.ListenerEvent, 1)
+	s, err := newEventSink(context.Background(), ch, nil)
+	assert.NoError(t, err)
+
+	ev := &ffcapi.ListenerEvent{}
+	assert.NoError(t, s.Push(context.Background(), ev))
+	assert.Same(t, ev, <-ch)
+}
+
+func TestEventSinkChannelPushCancellation(t *testing.T) {
+	ch := make(chan *ffcapi.ListenerEvent) // unbuffered, nobody reading
+	s, err := newEventSink(context.Background(), ch, nil)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.Push(ctx, &ffcapi.ListenerEvent{})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestEventSinkDispatcherFlushesOnBatchSize(t *testing.T) {
+	var delivered [][]*ffcapi.ListenerEvent
+	s, err := newEventSink(context.Background(), nil, func(ctx context.Context, events []*ffcapi.ListenerEvent) error {
+		delivered = append(delivered, events)
+		return nil
+	})
+	assert.NoError(t, err)
+	s.batchSize = 2
+
+	assert.NoError(t, s.Push(context.Background(), &ffcapi.ListenerEvent{}))
+	assert.Empty(t, delivered)
+	assert.NoError(t, s.Push(context.Background(), &ffcapi.ListenerEvent{}))
+	assert.Len(t, delivered, 1)
+	assert.Len(t, delivered[0], 2)
+}
+
+func TestEventSinkDispatcherFlushDeliversPartialBatch(t *testing.T) {
+	var delivered [][]*ffcapi.ListenerEvent
+	s, err := newEventSink(context.Background(), nil, func(ctx context.Context, events []*ffcapi.ListenerEvent) error {
+		delivered = append(delivered, events)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Push(context.Background(), &ffcapi.ListenerEvent{}))
+	assert.Empty(t, delivered)
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Len(t, delivered, 1)
+	assert.Len(t, delivered[0], 1)
+}
+
+func TestEventSinkDispatcherErrorRetainsBatchForRetry(t *testing.T) {
+	calls := 0
+	s, err := newEventSink(context.Background(), nil, func(ctx context.Context, events []*ffcapi.ListenerEvent) error {
+		calls++
+		if calls == 1 {
+			return assert.AnError
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.Push(context.Background(), &ffcapi.ListenerEvent{}))
+	assert.ErrorIs(t, s.Flush(context.Background()), assert.AnError)
+	assert.Len(t, s.batch, 1, "undelivered batch must be retained for the next flush")
+
+	assert.NoError(t, s.Flush(context.Background()))
+	assert.Empty(t, s.batch)
+	assert.Equal(t, 2, calls)
+}
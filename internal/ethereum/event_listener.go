@@ -0,0 +1,116 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/hyperledger/firefly-common/pkg/i18n"
+	"github.com/hyperledger/firefly-evmconnect/internal/msgs"
+	"github.com/hyperledger/firefly-signer/pkg/abi"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+	"golang.org/x/crypto/sha3"
+)
+
+// listener holds the state the stream keeps for one registered
+// ffcapi.EventListenerAddRequest: its resolved address/topic0 filter, and the event and
+// method ABI resolved from its options. The stream loop matches logs by address/topic0
+// only; it does not decode log data with the stored ABI.
+type listener struct {
+	id         string
+	streamID   string
+	name       string
+	address    string
+	topic0     string
+	event      *abi.Entry
+	methods    abi.ABI
+	checkpoint *listenerCheckpoint
+}
+
+// resolvedListenerOptions is the parsed, canonical form of a ffcapi.EventListenerOptions -
+// the same thing EventListenerVerifyOptions reports back to the caller, and what
+// EventListenerAdd/EventStreamStart/EventListenerReplay all need internally to build the
+// (address, topic0) filter pair a stream or replay query actually runs against.
+type resolvedListenerOptions struct {
+	address           string
+	topic0            string
+	event             *abi.Entry
+	methods           abi.ABI
+	resolvedOptions   []byte
+	resolvedSignature string
+}
+
+// parseListenerOptions validates and resolves a ffcapi.EventListenerOptions filter/options
+// pair. badFilterMsg selects the error reported for a malformed Filters entry - callers
+// pass different message keys because EventListenerAdd/EventStreamStart and
+// EventListenerVerifyOptions report different FFCAPI-visible error codes for the same
+// underlying failure, even though the parsing logic is identical.
+func parseListenerOptions(ctx context.Context, opts *ffcapi.EventListenerOptions, badFilterMsg i18n.MessageKey) (*resolvedListenerOptions, error) {
+	if len(opts.Filters) == 0 {
+		return nil, i18n.NewError(ctx, badFilterMsg, "no filters supplied")
+	}
+
+	var filter struct {
+		Address string     `json:"address"`
+		Event   *abi.Entry `json:"event"`
+	}
+	if err := json.Unmarshal(opts.Filters[0].Bytes(), &filter); err != nil {
+		return nil, i18n.NewError(ctx, badFilterMsg, err)
+	}
+
+	resolved := &resolvedListenerOptions{
+		address: strings.ToLower(filter.Address),
+		event:   filter.Event,
+	}
+	if filter.Event != nil {
+		resolved.resolvedSignature = resolved.address + ":" + filter.Event.String()
+		resolved.topic0 = eventTopic0(filter.Event)
+	}
+
+	if opts.Options != nil {
+		var optsCheck struct {
+			Methods abi.ABI `json:"methods"`
+		}
+		if err := json.Unmarshal(opts.Options.Bytes(), &optsCheck); err != nil {
+			return nil, i18n.NewError(ctx, msgs.MsgInvalidOptions, err)
+		}
+		resolved.methods = optsCheck.Methods
+		b, err := json.Marshal(&optsCheck)
+		if err != nil {
+			return nil, i18n.NewError(ctx, msgs.MsgInvalidOptions, err)
+		}
+		resolved.resolvedOptions = b
+	}
+
+	return resolved, nil
+}
+
+// eventTopic0 computes the log topic0 (keccak256 of the canonical event signature) used
+// to filter/match logs for an event ABI entry - the same derivation
+// EventListenerVerifyOptions exercises via ResolvedSignature, reused here so
+// EventStreamStart, EventListenerAdd and EventListenerReplay all match logs the same way.
+func eventTopic0(event *abi.Entry) string {
+	if event == nil {
+		return ""
+	}
+	h := sha3.NewLegacyKeccak256()
+	h.Write([]byte(event.String()))
+	return "0x" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,272 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/hyperledger/firefly-common/pkg/config"
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+)
+
+// ConfigEventsMaxListenersPerFilter caps how many listeners a single upstream
+// eth_newFilter registration is allowed to serve before a new shard is opened
+const ConfigEventsMaxListenersPerFilter = "events.maxListenersPerFilter"
+
+// defaultMaxListenersPerFilter is the shard size used when the config key above is unset
+const defaultMaxListenersPerFilter = 50
+
+func initEventMuxConfig(section config.Section) {
+	section.AddKnownKey(ConfigEventsMaxListenersPerFilter, defaultMaxListenersPerFilter)
+}
+
+// filterRoute is the (address, topic0) pair a single listener matches against. Multiple
+// listeners on the same stream commonly share one or both of these, which is exactly what
+// makes coalescing them behind one upstream filter possible.
+type filterRoute struct {
+	address string
+	topic0  string
+}
+
+// filterShard is one physical eth_newFilter registration, covering the union of
+// addresses/topic0s across every listener currently assigned to it. generation and dead
+// let recreateFilter recognize, once its eth_newFilter round trip lands, whether a
+// concurrent AddListener/RemoveListener against the same shard has since committed a
+// newer registration (or removed the shard outright) - see recreateFilter.
+type filterShard struct {
+	filterID   *ethtypes.HexInteger
+	listeners  map[string]filterRoute // listenerID -> route
+	generation int
+	dead       bool
+}
+
+// filterMultiplexer coalesces listeners sharing a stream into as few upstream
+// eth_newFilter registrations as the configured shard size allows, instead of the
+// one-filter-per-listener scheme this replaces. Incoming eth_getFilterChanges batches are
+// fanned out in-process by matching each log's (address, topic0) against the routing
+// table, so per-listener checkpoint/HWM semantics are unaffected by the coalescing.
+type filterMultiplexer struct {
+	// mux guards shard membership (m.shards and each shard's listeners/filterID). It is
+	// never held across an RPC call: AddListener/RemoveListener/recreateFilter compute
+	// what they need to send under the lock, release it for the eth_newFilter/
+	// eth_uninstallFilter round trip, then briefly re-take it to commit the result. This
+	// also keeps RouteLog - the per-log hot path - from ever blocking on an in-flight
+	// filter registration.
+	mux                   sync.RWMutex
+	backend               rpcClient
+	maxListenersPerFilter int
+	shards                []*filterShard
+}
+
+func newFilterMultiplexer(backend rpcClient, maxListenersPerFilter int) *filterMultiplexer {
+	if maxListenersPerFilter <= 0 {
+		maxListenersPerFilter = defaultMaxListenersPerFilter
+	}
+	return &filterMultiplexer{backend: backend, maxListenersPerFilter: maxListenersPerFilter}
+}
+
+// AddListener assigns a listener to a shard with room (opening a new shard if none has
+// room), then re-registers that shard's upstream filter with the updated union of
+// addresses/topics - eth_newFilter criteria cannot be amended in place, so joining a
+// shard always means uninstalling its old filter and installing a new one.
+func (m *filterMultiplexer) AddListener(ctx context.Context, listenerID, address, topic0 string) error {
+	m.mux.Lock()
+
+	// a listener already assigned to a shard (e.g. a caller retry after a transient
+	// error) is updated in place rather than duplicated into a second shard, which would
+	// otherwise double-route its logs and leave a stale registration behind on removal
+	shard := m.shardFor(listenerID)
+	if shard == nil {
+		shard = m.shardWithRoom()
+		if shard == nil {
+			shard = &filterShard{listeners: make(map[string]filterRoute)}
+			m.shards = append(m.shards, shard)
+		}
+	}
+	shard.listeners[listenerID] = filterRoute{address: address, topic0: topic0}
+	shard.generation++
+	gen := shard.generation
+	addresses, topic0s := shardCriteria(shard)
+	m.mux.Unlock()
+
+	return m.recreateFilter(ctx, shard, gen, addresses, topic0s)
+}
+
+// shardFor returns the shard a listener is already assigned to, or nil
+func (m *filterMultiplexer) shardFor(listenerID string) *filterShard {
+	for _, s := range m.shards {
+		if _, ok := s.listeners[listenerID]; ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// RemoveListener drops a listener from whichever shard holds it, re-registering that
+// shard's filter with the narrower union, or uninstalling it outright if the shard is
+// now empty.
+func (m *filterMultiplexer) RemoveListener(ctx context.Context, listenerID string) error {
+	m.mux.Lock()
+
+	for i, shard := range m.shards {
+		if _, ok := shard.listeners[listenerID]; !ok {
+			continue
+		}
+		delete(shard.listeners, listenerID)
+		if len(shard.listeners) == 0 {
+			shard.dead = true
+			emptiedFilterID := shard.filterID
+			m.shards = append(m.shards[:i], m.shards[i+1:]...)
+			m.mux.Unlock()
+			if emptiedFilterID != nil {
+				_ = m.backend.Invoke(ctx, nil, "eth_uninstallFilter", emptiedFilterID)
+			}
+			return nil
+		}
+		shard.generation++
+		gen := shard.generation
+		addresses, topic0s := shardCriteria(shard)
+		m.mux.Unlock()
+		return m.recreateFilter(ctx, shard, gen, addresses, topic0s)
+	}
+
+	m.mux.Unlock()
+	return nil
+}
+
+// shardWithRoom returns the first shard with capacity for another listener, or nil if
+// every shard is full and a new one must be opened
+func (m *filterMultiplexer) shardWithRoom() *filterShard {
+	for _, s := range m.shards {
+		if len(s.listeners) < m.maxListenersPerFilter {
+			return s
+		}
+	}
+	return nil
+}
+
+// shardCriteria computes the union of addresses/topic0s across every listener on a shard,
+// called while holding m.mux so the caller can release it before the RPC round trip that
+// registers the result.
+func shardCriteria(shard *filterShard) (addresses []string, topic0s []string) {
+	addrSet := make(map[string]bool)
+	topicSet := make(map[string]bool)
+	for _, r := range shard.listeners {
+		addrSet[r.address] = true
+		topicSet[r.topic0] = true
+	}
+	addresses = make([]string, 0, len(addrSet))
+	for a := range addrSet {
+		addresses = append(addresses, a)
+	}
+	topic0s = make([]string, 0, len(topicSet))
+	for t := range topicSet {
+		topic0s = append(topic0s, t)
+	}
+	return addresses, topic0s
+}
+
+// recreateFilter installs a fresh eth_newFilter covering the given union of addresses/
+// topic0s, then uninstalls whatever filter previously served the shard. Neither RPC call is
+// made with m.mux held - AddListener/RemoveListener capture the shard's new criteria under
+// the lock and release it before calling this, so an in-flight registration never blocks
+// RouteLog, the per-log hot path every incoming batch goes through.
+//
+// gen is the shard's generation at the moment its caller captured addresses/topic0s. Two
+// AddListener/RemoveListener calls racing against the same shard each bump the generation
+// before releasing the lock, so only the call holding the latest generation commits,
+// whichever order the eth_newFilter responses land in. An older call recognizes - once its
+// own response lands - that its criteria snapshot is stale and discards its result instead
+// of clobbering the shard's filterID or uninstalling a filter a newer call is depending on.
+func (m *filterMultiplexer) recreateFilter(ctx context.Context, shard *filterShard, gen int, addresses, topic0s []string) error {
+	var newFilterID *ethtypes.HexInteger
+	err := m.backend.Invoke(ctx, &newFilterID, "eth_newFilter", map[string]interface{}{
+		"address": addresses,
+		"topics":  [][]string{topic0s},
+	})
+	if err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	if shard.dead || shard.generation != gen {
+		m.mux.Unlock()
+		_ = m.backend.Invoke(ctx, nil, "eth_uninstallFilter", newFilterID)
+		return nil
+	}
+	oldFilterID := shard.filterID
+	shard.filterID = newFilterID
+	m.mux.Unlock()
+
+	if oldFilterID != nil {
+		_ = m.backend.Invoke(ctx, nil, "eth_uninstallFilter", oldFilterID)
+	}
+	return nil
+}
+
+// FilterIDs returns the physical filter IDs the polling loop must call
+// eth_getFilterChanges against - one per shard, however many listeners that shard serves
+func (m *filterMultiplexer) FilterIDs() []*ethtypes.HexInteger {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	ids := make([]*ethtypes.HexInteger, 0, len(m.shards))
+	for _, s := range m.shards {
+		if s.filterID != nil {
+			ids = append(ids, s.filterID)
+		}
+	}
+	return ids
+}
+
+// RouteLog fans a single log out to every listener on this stream whose (address,
+// topic0) matches it - the in-process equivalent of what per-listener filters used to
+// provide for free, now that multiple listeners can share one upstream filter.
+func (m *filterMultiplexer) RouteLog(address string, topic0 string) []string {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+
+	var matched []string
+	for _, s := range m.shards {
+		for listenerID, r := range s.listeners {
+			if strings.EqualFold(r.address, address) && strings.EqualFold(r.topic0, topic0) {
+				matched = append(matched, listenerID)
+			}
+		}
+	}
+	return matched
+}
+
+// ShardCount reports how many physical filters currently back this stream's listeners -
+// used by tests to demonstrate the reduction coalescing achieves over one-per-listener
+func (m *filterMultiplexer) ShardCount() int {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	return len(m.shards)
+}
+
+// ShardFilterID returns the physical filter ID backing the shard a listener is currently
+// assigned to, or nil if the listener is not (or no longer) registered
+func (m *filterMultiplexer) ShardFilterID(listenerID string) *ethtypes.HexInteger {
+	m.mux.RLock()
+	defer m.mux.RUnlock()
+	if shard := m.shardFor(listenerID); shard != nil {
+		return shard.filterID
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCountingFilterBackend() (*httpOnlyBackend, *int) {
+	newFilterCalls := 0
+	nextID := int64(0)
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		switch method {
+		case "eth_newFilter":
+			newFilterCalls++
+			nextID++
+			*result.(**ethtypes.HexInteger) = ethtypes.NewHexInteger64(nextID)
+		case "eth_uninstallFilter":
+			// no-op
+		}
+		return nil
+	}}
+	return backend, &newFilterCalls
+}
+
+func TestFilterMultiplexerCoalescesListeners(t *testing.T) {
+	backend, newFilterCalls := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 10)
+
+	for i := 0; i < 100; i++ {
+		listenerID := fmt.Sprintf("listener%d", i)
+		assert.NoError(t, m.AddListener(context.Background(), listenerID, "0xsameaddress", "0xsametopic0"))
+	}
+
+	// 100 listeners at a shard size of 10 should need only 10 physical filters, not 100 -
+	// a >=10x reduction in eth_getFilterChanges load versus one filter per listener
+	assert.Equal(t, 10, m.ShardCount())
+	assert.LessOrEqual(t, m.ShardCount()*10, 100)
+	t.Logf("eth_newFilter calls for 100 listeners: %d (vs %d under one-filter-per-listener)", *newFilterCalls, 100)
+}
+
+func TestFilterMultiplexerRoutesLogToMatchingListenersOnly(t *testing.T) {
+	backend, _ := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 10)
+
+	assert.NoError(t, m.AddListener(context.Background(), "listenerA", "0xaddr1", "0xtopicA"))
+	assert.NoError(t, m.AddListener(context.Background(), "listenerB", "0xaddr1", "0xtopicB"))
+	assert.NoError(t, m.AddListener(context.Background(), "listenerC", "0xaddr2", "0xtopicA"))
+
+	matched := m.RouteLog("0xaddr1", "0xtopicA")
+	assert.ElementsMatch(t, []string{"listenerA"}, matched)
+}
+
+func TestFilterMultiplexerAddListenerTwiceUpdatesInPlace(t *testing.T) {
+	backend, _ := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 10)
+
+	assert.NoError(t, m.AddListener(context.Background(), "l1", "0xaddr1", "0xtopic"))
+	assert.NoError(t, m.AddListener(context.Background(), "l1", "0xaddr2", "0xtopic"))
+
+	assert.Equal(t, 1, m.ShardCount(), "a retried/duplicate AddListener must not open a second shard for the same listener")
+	assert.Empty(t, m.RouteLog("0xaddr1", "0xtopic"), "the listener's route must be updated, not duplicated")
+	assert.ElementsMatch(t, []string{"l1"}, m.RouteLog("0xaddr2", "0xtopic"))
+}
+
+func TestFilterMultiplexerOpensNewShardWhenFull(t *testing.T) {
+	backend, newFilterCalls := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 2)
+
+	assert.NoError(t, m.AddListener(context.Background(), "l1", "0xaddr", "0xtopic"))
+	assert.NoError(t, m.AddListener(context.Background(), "l2", "0xaddr", "0xtopic"))
+	assert.Equal(t, 1, m.ShardCount())
+
+	assert.NoError(t, m.AddListener(context.Background(), "l3", "0xaddr", "0xtopic"))
+	assert.Equal(t, 2, m.ShardCount())
+	assert.Greater(t, *newFilterCalls, 2, "the new shard opened for l3 must register a filter of its own")
+}
+
+func TestFilterMultiplexerRemoveListenerUninstallsEmptyShard(t *testing.T) {
+	backend, _ := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 10)
+
+	assert.NoError(t, m.AddListener(context.Background(), "l1", "0xaddr", "0xtopic"))
+	assert.Equal(t, 1, m.ShardCount())
+
+	assert.NoError(t, m.RemoveListener(context.Background(), "l1"))
+	assert.Equal(t, 0, m.ShardCount())
+	assert.Empty(t, m.RouteLog("0xaddr", "0xtopic"))
+}
+
+func TestFilterMultiplexerRemoveListenerRecreatesFilterForSurvivors(t *testing.T) {
+	backend, newFilterCalls := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 10)
+
+	assert.NoError(t, m.AddListener(context.Background(), "l1", "0xaddr1", "0xtopic"))
+	assert.NoError(t, m.AddListener(context.Background(), "l2", "0xaddr2", "0xtopic"))
+	callsBeforeRemove := *newFilterCalls
+
+	assert.NoError(t, m.RemoveListener(context.Background(), "l1"))
+	assert.Greater(t, *newFilterCalls, callsBeforeRemove)
+	assert.ElementsMatch(t, []string{"l2"}, m.RouteLog("0xaddr2", "0xtopic"))
+	assert.Empty(t, m.RouteLog("0xaddr1", "0xtopic"))
+}
+
+func TestFilterMultiplexerFilterIDsOnePerShard(t *testing.T) {
+	backend, _ := newCountingFilterBackend()
+	m := newFilterMultiplexer(backend, 2)
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, m.AddListener(context.Background(), fmt.Sprintf("l%d", i), "0xaddr", "0xtopic"))
+	}
+	assert.Len(t, m.FilterIDs(), 3) // 5 listeners at shard size 2 => 3 shards
+}
+
+// TestFilterMultiplexerPollLoopReducesFilterChangesCalls simulates the stream loop's
+// polling behaviour - one eth_getFilterChanges per shard, per poll round - against a
+// multiplexer serving many listeners, and asserts the actual call count achieves the
+// >=10x reduction over one-filter-per-listener that coalescing claims, rather than just
+// logging the shard count as earlier versions of this test did.
+func TestFilterMultiplexerPollLoopReducesFilterChangesCalls(t *testing.T) {
+	getFilterChangesCalls := 0
+	nextID := int64(0)
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		switch method {
+		case "eth_newFilter":
+			nextID++
+			*result.(**ethtypes.HexInteger) = ethtypes.NewHexInteger64(nextID)
+		case "eth_getFilterChanges":
+			getFilterChangesCalls++
+			*result.(*[]*logJSONRPC) = []*logJSONRPC{}
+		}
+		return nil
+	}}
+
+	const listenerCount = 100
+	const shardSize = 10
+	m := newFilterMultiplexer(backend, shardSize)
+	for i := 0; i < listenerCount; i++ {
+		listenerID := fmt.Sprintf("listener%d", i)
+		assert.NoError(t, m.AddListener(context.Background(), listenerID, "0xsameaddress", "0xsametopic0"))
+	}
+
+	const pollRounds = 5
+	for round := 0; round < pollRounds; round++ {
+		for _, filterID := range m.FilterIDs() {
+			var logs []*logJSONRPC
+			assert.NoError(t, backend.Invoke(context.Background(), &logs, "eth_getFilterChanges", filterID))
+		}
+	}
+
+	baseline := listenerCount * pollRounds
+	assert.Equal(t, m.ShardCount()*pollRounds, getFilterChangesCalls)
+	assert.LessOrEqual(t, getFilterChangesCalls*10, baseline)
+}
+
+// TestFilterMultiplexerConcurrentAddListenersOnSameShardDoNotRace exercises two
+// AddListener calls racing to recreate the filter on the very same shard - nothing in
+// event_stream.go serializes concurrent EventListenerAdd RPCs into one stream's
+// multiplexer, so this is a real production scenario, not a contrived one. l1's
+// eth_newFilter round trip is held open until l2's has landed and committed, proving the
+// shard's generation check discards l1's now-stale result instead of clobbering l2's
+// filterID with an older registration.
+func TestFilterMultiplexerConcurrentAddListenersOnSameShardDoNotRace(t *testing.T) {
+	var muID sync.Mutex
+	nextID := int64(0)
+	releaseFirst := make(chan struct{})
+	firstStarted := make(chan struct{})
+
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		switch method {
+		case "eth_newFilter":
+			muID.Lock()
+			nextID++
+			id := nextID
+			muID.Unlock()
+			if id == 1 {
+				close(firstStarted)
+				<-releaseFirst
+			}
+			*result.(**ethtypes.HexInteger) = ethtypes.NewHexInteger64(id)
+		case "eth_uninstallFilter":
+			// no-op
+		}
+		return nil
+	}}
+
+	m := newFilterMultiplexer(backend, 10)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.AddListener(context.Background(), "l1", "0xaddr", "0xtopic")
+	}()
+	<-firstStarted // l1's eth_newFilter is in flight, blocked mid-RPC
+
+	// l2 joins the same (now-existing) shard and its registration completes in full
+	// before l1's slower, now-stale response is allowed to land
+	assert.NoError(t, m.AddListener(context.Background(), "l2", "0xaddr", "0xtopic"))
+
+	close(releaseFirst)
+	assert.NoError(t, <-errs)
+
+	assert.Equal(t, 1, m.ShardCount())
+	assert.ElementsMatch(t, []string{"l1", "l2"}, m.RouteLog("0xaddr", "0xtopic"))
+
+	filterID := m.ShardFilterID("l2")
+	assert.NotNil(t, filterID)
+	assert.Equal(t, int64(2), filterID.BigInt().Int64(), "the later, faster AddListener's filter must be the one left installed, not l1's stale one")
+}
@@ -0,0 +1,236 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/firefly-common/pkg/fftypes"
+	"github.com/hyperledger/firefly-common/pkg/i18n"
+	"github.com/hyperledger/firefly-evmconnect/internal/msgs"
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+)
+
+const (
+	// defaultReplayMaxBlockSpan is the widest eth_getLogs block range requested per call, absent an override
+	defaultReplayMaxBlockSpan = int64(10000)
+	// defaultReplayMaxResults caps the number of events returned in one EventListenerReplay page, absent an override
+	defaultReplayMaxResults = 100
+)
+
+// EventListenerReplayRequest is the input to EventListenerReplay: the same listener
+// options used to start a stream, plus a bounded block window and optional paging
+// controls. Unlike EventStreamStart, no persistent listener is registered and no
+// checkpoint is advanced - this is a one-shot, request/response query.
+type EventListenerReplayRequest struct {
+	ffcapi.EventListenerOptions
+	FromBlock    string `json:"fromBlock"`
+	ToBlock      string `json:"toBlock"`
+	MaxBlockSpan int64  `json:"maxBlockSpan,omitempty"`
+	MaxResults   int    `json:"maxResults,omitempty"`
+	Cursor       string `json:"cursor,omitempty"`
+}
+
+// EventListenerReplayResponse returns a bounded page of matching events. When Complete is
+// false, Cursor must be passed back on a subsequent EventListenerReplayRequest to resume
+// immediately after the last event returned.
+type EventListenerReplayResponse struct {
+	Events   []*ReplayedEvent `json:"events"`
+	Cursor   string           `json:"cursor,omitempty"`
+	Complete bool             `json:"complete"`
+}
+
+// ReplayedEvent is a single matching log returned by EventListenerReplay. Data carries the
+// log's raw data bytes as a hex string; it is not decoded against the event ABI.
+type ReplayedEvent struct {
+	BlockNumber      int64           `json:"blockNumber"`
+	BlockHash        string          `json:"blockHash"`
+	TransactionHash  string          `json:"transactionHash"`
+	TransactionIndex int64           `json:"transactionIndex"`
+	LogIndex         int64           `json:"logIndex"`
+	Data             fftypes.JSONAny `json:"data"`
+}
+
+// replayCursor is the opaque (to the caller) continuation state encoded into
+// EventListenerReplayResponse.Cursor. NextLogIndex resumes exactly after the last log
+// returned rather than rounding up to the next block - a popular contract can easily have
+// more matching logs after the one that hit maxResults in the same block, and rounding up
+// would skip them without ever returning them on any page.
+type replayCursor struct {
+	NextBlock    int64 `json:"nextBlock"`
+	NextLogIndex int64 `json:"nextLogIndex"`
+}
+
+// eventReplayer implements the EventListenerReplay query path: a synchronous,
+// bounded-range alternative to the persistent EventStreamStart/eth_newFilter listener,
+// for operators that want a fast backfill/audit read rather than a standing subscription.
+type eventReplayer struct {
+	backend rpcClient
+}
+
+func newEventReplayer(backend rpcClient) *eventReplayer {
+	return &eventReplayer{backend: backend}
+}
+
+// Replay executes (or resumes, via req.Cursor) a bounded eth_getLogs query, chunking the
+// range so no single call exceeds MaxBlockSpan blocks, and splitting a chunk in half and
+// retrying whenever the node reports too many results for the range requested.
+func (r *eventReplayer) Replay(ctx context.Context, req *EventListenerReplayRequest) (*EventListenerReplayResponse, ffcapi.ErrorReason, error) {
+	address, topic0, err := resolveReplayFilter(ctx, &req.EventListenerOptions)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+
+	fromBlock, toBlock, err := parseReplayRange(ctx, req.FromBlock, req.ToBlock)
+	if err != nil {
+		return nil, ffcapi.ErrorReasonInvalidInputs, err
+	}
+	// resumeLogIndexFloor excludes logs already returned on a previous page that fell in
+	// the same block as the cutoff; -1 is a no-op floor (every real logIndex is >= 0) for a
+	// fresh, cursor-less query.
+	resumeLogIndexFloor := int64(-1)
+	if req.Cursor != "" {
+		var cur replayCursor
+		if err := json.Unmarshal([]byte(req.Cursor), &cur); err != nil {
+			return nil, ffcapi.ErrorReasonInvalidInputs, i18n.NewError(ctx, msgs.MsgBadReplayCursor, err)
+		}
+		fromBlock = cur.NextBlock
+		resumeLogIndexFloor = cur.NextLogIndex
+	}
+
+	maxSpan := req.MaxBlockSpan
+	if maxSpan <= 0 {
+		maxSpan = defaultReplayMaxBlockSpan
+	}
+	maxResults := req.MaxResults
+	if maxResults <= 0 {
+		maxResults = defaultReplayMaxResults
+	}
+
+	events := make([]*ReplayedEvent, 0)
+	cursorBlock := fromBlock
+	for cursorBlock <= toBlock {
+		chunkTo := cursorBlock + maxSpan - 1
+		if chunkTo > toBlock {
+			chunkTo = toBlock
+		}
+
+		for {
+			var logs []*logJSONRPC
+			err := r.backend.Invoke(ctx, &logs, "eth_getLogs", map[string]interface{}{
+				"address":   address,
+				"topics":    []interface{}{topic0},
+				"fromBlock": ethtypes.NewHexInteger64(cursorBlock),
+				"toBlock":   ethtypes.NewHexInteger64(chunkTo),
+			})
+			if err != nil {
+				if isTooManyResultsErr(err) && chunkTo > cursorBlock {
+					chunkTo = cursorBlock + (chunkTo-cursorBlock)/2
+					continue
+				}
+				return nil, ffcapi.ErrorReasonDownstreamUnavailable, err
+			}
+			for _, l := range logs {
+				if l.BlockNumber.BigInt().Int64() == fromBlock && l.LogIndex.BigInt().Int64() < resumeLogIndexFloor {
+					// already returned on the page that produced this cursor
+					continue
+				}
+				events = append(events, logToReplayedEvent(l))
+				if len(events) >= maxResults {
+					next := replayCursor{
+						NextBlock:    l.BlockNumber.BigInt().Int64(),
+						NextLogIndex: l.LogIndex.BigInt().Int64() + 1,
+					}
+					cb, _ := json.Marshal(next)
+					return &EventListenerReplayResponse{Events: events, Cursor: string(cb), Complete: false}, "", nil
+				}
+			}
+			break
+		}
+
+		cursorBlock = chunkTo + 1
+	}
+
+	return &EventListenerReplayResponse{Events: events, Complete: true}, "", nil
+}
+
+// isTooManyResultsErr recognizes the family of "range too large"/"too many results"
+// errors returned by common node implementations (Infura, Geth, Alchemy) for eth_getLogs,
+// which this replayer handles by halving the offending chunk and retrying.
+func isTooManyResultsErr(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, substr := range []string{
+		"query returned more than",
+		"more than 10000 results",
+		"limit exceeded",
+		"response size exceeded",
+		"block range too large",
+	} {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReplayRange resolves the FromBlock/ToBlock strings on a replay request into
+// concrete block numbers; ToBlock may be omitted to mean "as far as FromBlock alone
+// requires" only once a range is known, so both must be explicit decimal numbers here -
+// "latest"/"pending" resolution is the caller's responsibility, matching how FromBlock is
+// already treated on EventStreamStart.
+func parseReplayRange(ctx context.Context, fromBlock, toBlock string) (from int64, to int64, err error) {
+	from, err = strconv.ParseInt(fromBlock, 10, 64)
+	if err != nil {
+		return 0, 0, i18n.NewError(ctx, msgs.MsgBadReplayBlockRange, fromBlock, toBlock, err)
+	}
+	to, err = strconv.ParseInt(toBlock, 10, 64)
+	if err != nil {
+		return 0, 0, i18n.NewError(ctx, msgs.MsgBadReplayBlockRange, fromBlock, toBlock, err)
+	}
+	if to < from {
+		return 0, 0, i18n.NewError(ctx, msgs.MsgBadReplayBlockRange, fromBlock, toBlock, "toBlock precedes fromBlock")
+	}
+	return from, to, nil
+}
+
+// resolveReplayFilter extracts the address/topic0 filter pair from the same
+// EventListenerOptions.Filters JSON shape accepted by EventStreamStart and
+// EventListenerVerifyOptions, computing topic0 from the event ABI the same way
+// EventListenerVerifyOptions does so a replay query actually filters by event signature
+// instead of matching every log at the address.
+func resolveReplayFilter(ctx context.Context, opts *ffcapi.EventListenerOptions) (address string, topic0 string, err error) {
+	resolved, err := parseListenerOptions(ctx, opts, msgs.MsgBadReplayFilter)
+	if err != nil {
+		return "", "", err
+	}
+	return resolved.address, resolved.topic0, nil
+}
+
+func logToReplayedEvent(l *logJSONRPC) *ReplayedEvent {
+	return &ReplayedEvent{
+		BlockNumber:      l.BlockNumber.BigInt().Int64(),
+		BlockHash:        l.BlockHash.String(),
+		TransactionHash:  l.TransactionHash.String(),
+		TransactionIndex: l.TransactionIndex.BigInt().Int64(),
+		LogIndex:         l.LogIndex.BigInt().Int64(),
+		Data:             *fftypes.JSONAnyPtr(`"` + l.Data.String() + `"`),
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hyperledger/firefly-common/pkg/fftypes"
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReplayRequest(fromBlock, toBlock string) *EventListenerReplayRequest {
+	return &EventListenerReplayRequest{
+		FromBlock: fromBlock,
+		ToBlock:   toBlock,
+		EventListenerOptions: ffcapi.EventListenerOptions{
+			Filters: []fftypes.JSONAny{*fftypes.JSONAnyPtr(`{
+				"address": "0x5600fF383458ae30dE902D096bA89f7F81f0a2fC",
+				"event": ` + abiTransferEvent + `
+			}`)},
+		},
+	}
+}
+
+func TestEventReplayerSinglePage(t *testing.T) {
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		assert.Equal(t, "eth_getLogs", method)
+		*result.(*[]*logJSONRPC) = []*logJSONRPC{
+			{
+				BlockNumber:      ethtypes.NewHexInteger64(100),
+				BlockHash:        ethtypes.HexBytes0xPrefix("0xblock"),
+				TransactionHash:  ethtypes.HexBytes0xPrefix("0xtx"),
+				TransactionIndex: ethtypes.NewHexInteger64(1),
+				LogIndex:         ethtypes.NewHexInteger64(0),
+				Data:             ethtypes.HexBytes0xPrefix("0x1234"),
+			},
+		}
+		return nil
+	}}
+
+	r := newEventReplayer(backend)
+	res, reason, err := r.Replay(context.Background(), newTestReplayRequest("0", "1000"))
+	assert.NoError(t, err)
+	assert.Empty(t, reason)
+	assert.True(t, res.Complete)
+	assert.Len(t, res.Events, 1)
+	assert.Equal(t, int64(100), res.Events[0].BlockNumber)
+}
+
+func TestEventReplayerPaginatesOnMaxResults(t *testing.T) {
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		*result.(*[]*logJSONRPC) = []*logJSONRPC{
+			{BlockNumber: ethtypes.NewHexInteger64(100), TransactionIndex: ethtypes.NewHexInteger64(0), LogIndex: ethtypes.NewHexInteger64(0)},
+			{BlockNumber: ethtypes.NewHexInteger64(101), TransactionIndex: ethtypes.NewHexInteger64(0), LogIndex: ethtypes.NewHexInteger64(0)},
+		}
+		return nil
+	}}
+
+	req := newTestReplayRequest("0", "1000")
+	req.MaxResults = 1
+	r := newEventReplayer(backend)
+	res, _, err := r.Replay(context.Background(), req)
+	assert.NoError(t, err)
+	assert.False(t, res.Complete)
+	assert.Len(t, res.Events, 1)
+	assert.NotEmpty(t, res.Cursor)
+
+	req2 := newTestReplayRequest("0", "1000")
+	req2.Cursor = res.Cursor
+	res2, _, err := r.Replay(context.Background(), req2)
+	assert.NoError(t, err)
+	assert.Len(t, res2.Events, 1)
+}
+
+func TestEventReplayerPaginatesMidBlockWithoutSkippingRemainingLogs(t *testing.T) {
+	// three matching logs all in the same block - a cutoff here must resume after the
+	// exact log, not round up to block+1 and silently drop the rest of the block
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		*result.(*[]*logJSONRPC) = []*logJSONRPC{
+			{BlockNumber: ethtypes.NewHexInteger64(100), TransactionIndex: ethtypes.NewHexInteger64(0), LogIndex: ethtypes.NewHexInteger64(0)},
+			{BlockNumber: ethtypes.NewHexInteger64(100), TransactionIndex: ethtypes.NewHexInteger64(1), LogIndex: ethtypes.NewHexInteger64(1)},
+			{BlockNumber: ethtypes.NewHexInteger64(100), TransactionIndex: ethtypes.NewHexInteger64(2), LogIndex: ethtypes.NewHexInteger64(2)},
+		}
+		return nil
+	}}
+
+	req := newTestReplayRequest("0", "1000")
+	req.MaxResults = 2
+	r := newEventReplayer(backend)
+	res, _, err := r.Replay(context.Background(), req)
+	assert.NoError(t, err)
+	assert.False(t, res.Complete)
+	assert.Len(t, res.Events, 2)
+	assert.Equal(t, int64(0), res.Events[0].LogIndex)
+	assert.Equal(t, int64(1), res.Events[1].LogIndex)
+	assert.NotEmpty(t, res.Cursor)
+
+	req2 := newTestReplayRequest("0", "1000")
+	req2.Cursor = res.Cursor
+	res2, _, err := r.Replay(context.Background(), req2)
+	assert.NoError(t, err)
+	assert.True(t, res2.Complete)
+	// the third log of block 100 must still be returned on the next page, not dropped
+	assert.Len(t, res2.Events, 1)
+	assert.Equal(t, int64(100), res2.Events[0].BlockNumber)
+	assert.Equal(t, int64(2), res2.Events[0].LogIndex)
+}
+
+func TestEventReplayerSplitsOnTooManyResults(t *testing.T) {
+	calls := 0
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+		calls++
+		if calls == 1 {
+			return assertErrTooManyResults{}
+		}
+		*result.(*[]*logJSONRPC) = []*logJSONRPC{}
+		return nil
+	}}
+
+	req := newTestReplayRequest("0", "1000")
+	r := newEventReplayer(backend)
+	res, _, err := r.Replay(context.Background(), req)
+	assert.NoError(t, err)
+	assert.True(t, res.Complete)
+	assert.Greater(t, calls, 1)
+}
+
+func TestEventReplayerBadRange(t *testing.T) {
+	r := newEventReplayer(&httpOnlyBackend{})
+	_, reason, err := r.Replay(context.Background(), newTestReplayRequest("1000", "0"))
+	assert.Error(t, err)
+	assert.Equal(t, ffcapi.ErrorReasonInvalidInputs, reason)
+}
+
+func TestEventReplayerBadCursor(t *testing.T) {
+	req := newTestReplayRequest("0", "1000")
+	req.Cursor = "{not json"
+	r := newEventReplayer(&httpOnlyBackend{})
+	_, _, err := r.Replay(context.Background(), req)
+	assert.Regexp(t, "FF23053", err)
+}
+
+func TestEventReplayerSendsTopic0Filter(t *testing.T) {
+	var params map[string]interface{}
+	backend := &httpOnlyBackend{invoke: func(ctx context.Context, result interface{}, method string, p ...interface{}) error {
+		assert.Equal(t, "eth_getLogs", method)
+		params = p[0].(map[string]interface{})
+		*result.(*[]*logJSONRPC) = []*logJSONRPC{}
+		return nil
+	}}
+
+	r := newEventReplayer(backend)
+	_, _, err := r.Replay(context.Background(), newTestReplayRequest("0", "1000"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "0x5600ff383458ae30de902d096ba89f7f81f0a2fc", params["address"])
+	assert.Equal(t, []interface{}{"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"}, params["topics"])
+}
+
+type assertErrTooManyResults struct{}
+
+func (assertErrTooManyResults) Error() string {
+	return "query returned more than 10000 results"
+}
@@ -0,0 +1,221 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"sync"
+
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+)
+
+// reorgRingSize bounds how many recently-delivered log identities are retained per
+// listener for cross-checking against removed=true entries on later filter polls
+const reorgRingSize = 256
+
+// deliveredLogID identifies a single previously-delivered log well enough to recognize it
+// again if the node later reports it as removed by a reorg
+type deliveredLogID struct {
+	blockHash string
+	txHash    string
+	logIndex  int64
+}
+
+// ringEntry pairs a delivered log's identity with the checkpoint it was delivered at, so a
+// later revoke of that identity can rewind to whichever entry immediately preceded it in
+// delivery order, rather than to a single HWM that never moves forward again.
+type ringEntry struct {
+	id         deliveredLogID
+	checkpoint *listenerCheckpoint
+}
+
+// listenerReorgState tracks, for one listener, the logs recently handed to the stream
+// channel (in a bounded ring) and the two high-water marks this chunk introduces:
+// delivered (the latest log pushed onto the channel, rewound to the preceding delivered
+// log when a reorg revokes one) and confirmed (the HWM once the chain has not reorganized
+// past it).
+type listenerReorgState struct {
+	ring      []ringEntry
+	ringStart int
+	delivered *listenerCheckpoint
+	confirmed *listenerCheckpoint
+}
+
+func newListenerReorgState() *listenerReorgState {
+	return &listenerReorgState{ring: make([]ringEntry, 0, reorgRingSize)}
+}
+
+func (s *listenerReorgState) remember(entry ringEntry) {
+	if len(s.ring) < reorgRingSize {
+		s.ring = append(s.ring, entry)
+		return
+	}
+	s.ring[s.ringStart] = entry
+	s.ringStart = (s.ringStart + 1) % reorgRingSize
+}
+
+// indexOf returns the ring slot holding id, if it is still retained
+func (s *listenerReorgState) indexOf(id deliveredLogID) (int, bool) {
+	for i, existing := range s.ring {
+		if existing.id == id {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// precedingCheckpoint walks the ring backwards from slot i, in delivery order, looking for
+// the checkpoint of the nearest earlier entry that has not itself been evicted. It returns
+// nil once it runs out of retained history (i is the oldest entry the ring still holds),
+// meaning the revoke should rewind all the way back to the listener's original resume
+// checkpoint.
+func (s *listenerReorgState) precedingCheckpoint(i int) *listenerCheckpoint {
+	n := len(s.ring)
+	oldest := 0
+	if n == reorgRingSize {
+		oldest = s.ringStart
+	}
+	for j := i; j != oldest; {
+		j = (j - 1 + n) % n
+		if s.ring[j].checkpoint != nil {
+			return s.ring[j].checkpoint
+		}
+		if j == oldest {
+			break
+		}
+	}
+	return nil
+}
+
+// evict removes a previously-delivered log identity from the ring once it has been
+// revoked, so a later removed=true report against the same identity (e.g. a duplicate
+// eth_getFilterChanges entry) is not mistaken for a second, independent revocation
+func (s *listenerReorgState) evict(i int) {
+	s.ring[i] = ringEntry{}
+}
+
+// reorgTracker owns per-listener reorg bookkeeping for a stream: it records the logs the
+// stream has delivered, recognizes when the node later reports one of them as removed
+// (chain reorganized under it), and produces the revoke ffcapi.ListenerEvent plus the
+// rewound checkpoint the listener must resume from.
+type reorgTracker struct {
+	mux     sync.Mutex
+	streams map[string]*listenerReorgState // listenerID -> state
+}
+
+func newReorgTracker() *reorgTracker {
+	return &reorgTracker{streams: make(map[string]*listenerReorgState)}
+}
+
+func (t *reorgTracker) stateFor(listenerID string) *listenerReorgState {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	s := t.streams[listenerID]
+	if s == nil {
+		s = newListenerReorgState()
+		t.streams[listenerID] = s
+	}
+	return s
+}
+
+// recordDelivered marks a log as delivered to the stream channel, extending the
+// delivered HWM and remembering its identity so a later removed=true report against the
+// same (blockHash, txHash, logIndex) can be recognized as a revocation rather than a new event.
+func (t *reorgTracker) recordDelivered(listenerID string, l *logJSONRPC) {
+	s := t.stateFor(listenerID)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	cp := &listenerCheckpoint{
+		Block:            l.BlockNumber.BigInt().Int64(),
+		TransactionIndex: l.TransactionIndex.BigInt().Int64(),
+		LogIndex:         l.LogIndex.BigInt().Int64(),
+	}
+	s.remember(ringEntry{
+		id: deliveredLogID{
+			blockHash: l.BlockHash.String(),
+			txHash:    l.TransactionHash.String(),
+			logIndex:  l.LogIndex.BigInt().Int64(),
+		},
+		checkpoint: cp,
+	})
+	s.delivered = cp
+	if s.confirmed == nil {
+		s.confirmed = cp
+	}
+}
+
+// confirm advances the confirmed HWM once a block is deep enough not to be revoked. No
+// production caller has a confirmations signal to drive this yet - ProcessFilterChanges
+// does not depend on it, computing its rewind target from the delivery ring instead - so
+// today this is exercised only by tests exploring the delivered/confirmed distinction.
+func (t *reorgTracker) confirm(listenerID string, cp *listenerCheckpoint) {
+	s := t.stateFor(listenerID)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	s.confirmed = cp
+}
+
+// ProcessFilterChanges splits a raw eth_getFilterChanges/eth_subscribe batch into
+// forward-going (non-removed) logs and revoke events for any entry flagged removed=true
+// that matches a previously-delivered log identity. The rewind checkpoint on each revoke
+// event is computed from the delivery ring itself - the log immediately preceding the
+// revoked one in delivery order, i.e. the last common ancestor the listener should resume
+// from - rather than from a single confirmed HWM, which nothing in production ever
+// advances past the listener's first delivered log.
+func (t *reorgTracker) ProcessFilterChanges(listenerID string, logs []*logJSONRPC) (forward []*logJSONRPC, revokes []*ffcapi.ListenerEvent) {
+	s := t.stateFor(listenerID)
+	for _, l := range logs {
+		id := deliveredLogID{
+			blockHash: l.BlockHash.String(),
+			txHash:    l.TransactionHash.String(),
+			logIndex:  l.LogIndex.BigInt().Int64(),
+		}
+		t.mux.Lock()
+		i, ok := s.indexOf(id)
+		if !l.Removed || !ok {
+			t.mux.Unlock()
+			forward = append(forward, l)
+			continue
+		}
+		rewindTo := s.precedingCheckpoint(i)
+		s.evict(i)
+		s.delivered = rewindTo
+		s.confirmed = rewindTo
+		t.mux.Unlock()
+		revokes = append(revokes, &ffcapi.ListenerEvent{
+			Checkpoint: rewindTo,
+			Removed:    true,
+		})
+	}
+	return forward, revokes
+}
+
+// HWM returns the listener's delivered and confirmed high-water marks separately.
+// EventListenerHWM reports only the delivered mark; the confirmed mark is not exposed
+// through it.
+func (t *reorgTracker) HWM(listenerID string) (delivered *listenerCheckpoint, confirmed *listenerCheckpoint) {
+	s := t.stateFor(listenerID)
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return s.delivered, s.confirmed
+}
+
+// forget drops all reorg-tracking state for a removed listener
+func (t *reorgTracker) forget(listenerID string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	delete(t.streams, listenerID)
+}
@@ -0,0 +1,152 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"testing"
+
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func testLog(blockHash string, block, txIndex, logIndex int64, removed bool) *logJSONRPC {
+	return &logJSONRPC{
+		BlockHash:        ethtypes.HexBytes0xPrefix(blockHash),
+		TransactionHash:  ethtypes.HexBytes0xPrefix("0xtx"),
+		BlockNumber:      ethtypes.NewHexInteger64(block),
+		TransactionIndex: ethtypes.NewHexInteger64(txIndex),
+		LogIndex:         ethtypes.NewHexInteger64(logIndex),
+		Removed:          removed,
+	}
+}
+
+func TestReorgTrackerRevokesReplacedLog(t *testing.T) {
+	tracker := newReorgTracker()
+
+	// original chain: two logs delivered on block 100 (canonical) and block 101 (forked away)
+	tracker.recordDelivered("listener1", testLog("0xblock100", 100, 0, 0, false))
+	tracker.recordDelivered("listener1", testLog("0xblock101a", 101, 0, 0, false))
+	tracker.confirm("listener1", &listenerCheckpoint{Block: 100, TransactionIndex: 0, LogIndex: 0})
+
+	// competing chain: eth_getFilterChanges reports block 101a withdrawn, and replacement 101b delivered
+	forward, revokes := tracker.ProcessFilterChanges("listener1", []*logJSONRPC{
+		testLog("0xblock101a", 101, 0, 0, true),
+		testLog("0xblock101b", 101, 0, 0, false),
+	})
+
+	assert.Len(t, revokes, 1)
+	assert.True(t, revokes[0].Removed)
+	assert.Equal(t, int64(100), revokes[0].Checkpoint.(*listenerCheckpoint).Block)
+
+	assert.Len(t, forward, 1)
+	assert.Equal(t, "0xblock101b", string(forward[0].BlockHash))
+}
+
+func TestReorgTrackerProcessFilterChangesRewindsHWM(t *testing.T) {
+	tracker := newReorgTracker()
+	tracker.recordDelivered("listener1", testLog("0xblock100", 100, 0, 0, false))
+	tracker.recordDelivered("listener1", testLog("0xblock101a", 101, 0, 0, false))
+	tracker.confirm("listener1", &listenerCheckpoint{Block: 100, TransactionIndex: 0, LogIndex: 0})
+
+	_, revokes := tracker.ProcessFilterChanges("listener1", []*logJSONRPC{
+		testLog("0xblock101a", 101, 0, 0, true),
+	})
+	assert.Len(t, revokes, 1)
+
+	// HWM must reflect the rewind immediately - a caller polling EventListenerHWM right
+	// after the revoke must not still see the reverted log as the delivered checkpoint
+	delivered, confirmed := tracker.HWM("listener1")
+	assert.Equal(t, int64(100), delivered.Block)
+	assert.Equal(t, int64(100), confirmed.Block)
+
+	// the reverted identity must no longer be revocable a second time
+	_, revokes = tracker.ProcessFilterChanges("listener1", []*logJSONRPC{
+		testLog("0xblock101a", 101, 0, 0, true),
+	})
+	assert.Empty(t, revokes)
+}
+
+func TestReorgTrackerRevokeRewindsToLastAncestorNotFirstEverDelivered(t *testing.T) {
+	tracker := newReorgTracker()
+
+	// a long-lived listener: many blocks delivered over its lifetime, confirm() never
+	// called (as in production today) so the old bug - rewinding to the very first log
+	// this listener ever saw - would send it back to block 100 instead of block 102
+	tracker.recordDelivered("listener1", testLog("0xblock100", 100, 0, 0, false))
+	tracker.recordDelivered("listener1", testLog("0xblock101", 101, 0, 0, false))
+	tracker.recordDelivered("listener1", testLog("0xblock102", 102, 0, 0, false))
+	tracker.recordDelivered("listener1", testLog("0xblock103a", 103, 0, 0, false))
+
+	// only the most recent block forks away
+	_, revokes := tracker.ProcessFilterChanges("listener1", []*logJSONRPC{
+		testLog("0xblock103a", 103, 0, 0, true),
+	})
+
+	assert.Len(t, revokes, 1)
+	assert.Equal(t, int64(102), revokes[0].Checkpoint.(*listenerCheckpoint).Block)
+
+	delivered, confirmed := tracker.HWM("listener1")
+	assert.Equal(t, int64(102), delivered.Block)
+	assert.Equal(t, int64(102), confirmed.Block)
+}
+
+func TestReorgTrackerIgnoresUnknownRemoved(t *testing.T) {
+	tracker := newReorgTracker()
+	tracker.recordDelivered("listener1", testLog("0xblock100", 100, 0, 0, false))
+
+	// a removed=true entry the tracker never delivered is not something it can revoke
+	forward, revokes := tracker.ProcessFilterChanges("listener1", []*logJSONRPC{
+		testLog("0xunknown", 99, 0, 0, true),
+	})
+	assert.Empty(t, revokes)
+	assert.Len(t, forward, 1)
+}
+
+func TestReorgTrackerHWMTracksDeliveredAndConfirmedSeparately(t *testing.T) {
+	tracker := newReorgTracker()
+	tracker.recordDelivered("listener1", testLog("0xblock100", 100, 0, 0, false))
+	tracker.recordDelivered("listener1", testLog("0xblock101", 101, 0, 0, false))
+	tracker.confirm("listener1", &listenerCheckpoint{Block: 100, TransactionIndex: 0, LogIndex: 0})
+
+	delivered, confirmed := tracker.HWM("listener1")
+	assert.Equal(t, int64(101), delivered.Block)
+	assert.Equal(t, int64(100), confirmed.Block)
+}
+
+func TestReorgTrackerRingIsBounded(t *testing.T) {
+	tracker := newReorgTracker()
+	for i := int64(0); i < reorgRingSize+10; i++ {
+		tracker.recordDelivered("listener1", testLog("0xblock", 100+i, 0, i, false))
+	}
+	s := tracker.stateFor("listener1")
+	assert.Len(t, s.ring, reorgRingSize)
+
+	// the oldest entries (logIndex 0..9) were evicted and can no longer be revoked
+	_, revokes := tracker.ProcessFilterChanges("listener1", []*logJSONRPC{
+		testLog("0xblock", 100, 0, 0, true),
+	})
+	assert.Empty(t, revokes)
+}
+
+func TestReorgTrackerForget(t *testing.T) {
+	tracker := newReorgTracker()
+	tracker.recordDelivered("listener1", testLog("0xblock100", 100, 0, 0, false))
+	tracker.forget("listener1")
+	delivered, confirmed := tracker.HWM("listener1")
+	assert.Nil(t, delivered)
+	assert.Nil(t, confirmed)
+}
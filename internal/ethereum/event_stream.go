@@ -0,0 +1,249 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/firefly-common/pkg/fftypes"
+	"github.com/hyperledger/firefly-evmconnect/internal/jsonrpc"
+	"github.com/hyperledger/firefly-evmconnect/internal/msgs"
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+)
+
+// eventPollingInterval is the delay between eth_getFilterChanges sweeps of the
+// multiplexer's shards, for listeners not covered by subscribe delivery
+const eventPollingInterval = 2 * time.Second
+
+// eventStream is the running state behind one EventStreamStart call: the multiplexed
+// filters and reorg tracking its listeners share, the (optional) push-based subscriber
+// running alongside the eth_getFilterChanges poll loop, and the sink decoded events are
+// delivered through.
+type eventStream struct {
+	id            *fftypes.UUID
+	ctx           context.Context
+	backend       jsonrpc.Client
+	sink          *eventSink
+	mux           *filterMultiplexer
+	reorg         *reorgTracker
+	subscriber    *eventSubscriber
+	blockListener chan<- *ffcapi.BlockHashEvent
+
+	listenersMux sync.Mutex
+	listeners    map[fftypes.UUID]*listener
+
+	pollDone chan struct{}
+}
+
+// newEventStream builds a stream's runtime state. It does not start the poll loop or
+// register any listeners - the caller (EventStreamStart) adds the initial listeners one at
+// a time and starts the poll loop only after all of them have been added, so a bad
+// listener fails the call before polling begins. The polling loop and the push subscriber
+// share one reorgTracker - a
+// listener uses exactly one of the two delivery paths at a time, but EventListenerHWM must
+// report the same thing regardless of which one is currently moving its logs.
+func newEventStream(
+	id *fftypes.UUID,
+	streamCtx context.Context,
+	backend jsonrpc.Client,
+	maxListenersPerFilter int,
+	mode deliveryMode,
+	sink *eventSink,
+	blockListener chan<- *ffcapi.BlockHashEvent,
+) *eventStream {
+	reorg := newReorgTracker()
+	return &eventStream{
+		id:            id,
+		ctx:           streamCtx,
+		backend:       backend,
+		sink:          sink,
+		mux:           newFilterMultiplexer(backend, maxListenersPerFilter),
+		reorg:         reorg,
+		subscriber:    newEventSubscriber(streamCtx, backend, mode, sink, reorg, blockListener),
+		blockListener: blockListener,
+		listeners:     make(map[fftypes.UUID]*listener),
+		pollDone:      make(chan struct{}),
+	}
+}
+
+// addListener resolves one listener and registers it with the stream's push subscriber
+// when subscribe delivery is available, or with its filter multiplexer otherwise. On the
+// subscribe path any gap between the listener's resume checkpoint and the current head is
+// closed with a synchronous eth_getLogs backfill; on the polling path only the logs its
+// shard's filter has matched since it was installed are delivered (see backfillListener).
+func (s *eventStream) addListener(ctx context.Context, req *ffcapi.EventListenerAddRequest) error {
+	resolved, err := parseListenerOptions(ctx, &req.EventListenerOptions, msgs.MsgInvalidOptions)
+	if err != nil {
+		return err
+	}
+
+	l := &listener{
+		id:         req.ListenerID.String(),
+		streamID:   req.StreamID.String(),
+		name:       req.Name,
+		address:    resolved.address,
+		topic0:     resolved.topic0,
+		event:      resolved.event,
+		methods:    resolved.methods,
+		checkpoint: resolveListenerCheckpoint(req.Checkpoint),
+	}
+
+	s.listenersMux.Lock()
+	s.listeners[*req.ListenerID] = l
+	s.listenersMux.Unlock()
+
+	headBlock, err := s.currentHeadBlock(ctx)
+	if err != nil {
+		return err
+	}
+
+	if s.subscriber.available() {
+		return s.subscriber.addListener(ctx, l.id, l.address, l.topic0, l.checkpoint.Block, headBlock)
+	}
+
+	if err := s.mux.AddListener(ctx, l.id, l.address, l.topic0); err != nil {
+		return err
+	}
+	return s.backfillListener(ctx, l)
+}
+
+// removeListener tears down a listener's filter membership, push subscription (if any) and
+// reorg-tracking state
+func (s *eventStream) removeListener(ctx context.Context, listenerID *fftypes.UUID) error {
+	s.listenersMux.Lock()
+	l, ok := s.listeners[*listenerID]
+	delete(s.listeners, *listenerID)
+	s.listenersMux.Unlock()
+	if !ok {
+		return nil
+	}
+	s.subscriber.removeListener(ctx, l.id)
+	s.reorg.forget(l.id)
+	return s.mux.RemoveListener(ctx, l.id)
+}
+
+// getListener returns a registered listener by ID, or nil if it is not (or no longer) registered
+func (s *eventStream) getListener(listenerID *fftypes.UUID) *listener {
+	s.listenersMux.Lock()
+	defer s.listenersMux.Unlock()
+	return s.listeners[*listenerID]
+}
+
+// currentHeadBlock fetches the node's current block height, used both to decide whether a
+// newly added listener needs a catch-up backfill and as the resubscribe-after-reconnect floor
+func (s *eventStream) currentHeadBlock(ctx context.Context) (int64, error) {
+	var headBlock ethtypes.HexInteger
+	if err := s.backend.Invoke(ctx, &headBlock, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	return headBlock.BigInt().Int64(), nil
+}
+
+// backfillListener delivers what eth_getFilterLogs reports for the shard the listener was
+// just placed on, so a freshly (re)installed eth_newFilter does not miss logs matched since
+// its creation. The filter is installed without a fromBlock, so logs between the listener's
+// resume checkpoint and the filter's creation are not fetched.
+func (s *eventStream) backfillListener(ctx context.Context, l *listener) error {
+	filterID := s.mux.ShardFilterID(l.id)
+	if filterID == nil {
+		return nil
+	}
+	var logs []*logJSONRPC
+	if err := s.backend.Invoke(ctx, &logs, "eth_getFilterLogs", filterID); err != nil {
+		return err
+	}
+	return s.deliverLogs(ctx, logs)
+}
+
+// startPolling launches the background eth_getFilterChanges sweep used for any listener not
+// covered by subscribe delivery; it exits once the stream's context is cancelled
+func (s *eventStream) startPolling() {
+	go func() {
+		defer close(s.pollDone)
+		ticker := time.NewTicker(eventPollingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+				s.pollOnce(s.ctx)
+			}
+		}
+	}()
+}
+
+// pollOnce runs a single eth_getFilterChanges sweep across every shard the multiplexer
+// currently maintains - one call per shard, not one per listener. A batch the sink still
+// holds from a failed dispatch is retried first, and the sweep stops at the first failed
+// delivery, so no new filter changes are fetched until the dispatcher accepts the batch.
+func (s *eventStream) pollOnce(ctx context.Context) {
+	filterIDs := s.mux.FilterIDs()
+	if len(filterIDs) == 0 {
+		return
+	}
+	if err := s.sink.Flush(ctx); err != nil {
+		return
+	}
+	for _, filterID := range filterIDs {
+		var logs []*logJSONRPC
+		if err := s.backend.Invoke(ctx, &logs, "eth_getFilterChanges", filterID); err != nil {
+			continue
+		}
+		if err := s.deliverLogs(ctx, logs); err != nil {
+			return
+		}
+	}
+}
+
+// deliverLogs fans a raw batch out to the listeners it matches, splitting each listener's
+// share through the reorg tracker before handing the result to the stream's sink
+func (s *eventStream) deliverLogs(ctx context.Context, logs []*logJSONRPC) error {
+	byListener := make(map[string][]*logJSONRPC)
+	for _, l := range logs {
+		for _, listenerID := range s.mux.RouteLog(string(l.Address), l.topic0()) {
+			byListener[listenerID] = append(byListener[listenerID], l)
+		}
+	}
+	for listenerID, matched := range byListener {
+		forward, revokes := s.reorg.ProcessFilterChanges(listenerID, matched)
+		for _, revoke := range revokes {
+			if err := s.sink.Push(ctx, revoke); err != nil {
+				return err
+			}
+		}
+		for _, l := range forward {
+			s.reorg.recordDelivered(listenerID, l)
+			if err := s.sink.Push(ctx, logToListenerEvent(listenerID, l)); err != nil {
+				return err
+			}
+		}
+	}
+	return s.sink.Flush(ctx)
+}
+
+// resolveListenerCheckpoint returns the caller-supplied resume checkpoint, or a zero
+// checkpoint (resume from genesis) when none was given
+func resolveListenerCheckpoint(cp ffcapi.EventListenerCheckpoint) *listenerCheckpoint {
+	if lcp, ok := cp.(*listenerCheckpoint); ok && lcp != nil {
+		return lcp
+	}
+	return &listenerCheckpoint{}
+}
@@ -0,0 +1,278 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/firefly-signer/pkg/ethtypes"
+	"github.com/hyperledger/firefly-transaction-manager/pkg/ffcapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeWSBackend is a minimal stand-in for a WebSocket-backed jsonrpc.Client, satisfying
+// both rpcClient and wsSubscriber, used to exercise the subscribe delivery path without a
+// real node.
+type fakeWSBackend struct {
+	invoke      func(ctx context.Context, result interface{}, method string, params ...interface{}) error
+	mux         sync.Mutex // guards subscribes, written from the pump goroutine in reconnect tests
+	subscribes  int
+	subFails    bool
+	reconnected chan struct{}
+}
+
+func (f *fakeWSBackend) subscribeCount() int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.subscribes
+}
+
+type fakeSub struct {
+	id string
+}
+
+func (s *fakeSub) LocalID() string                       { return s.id }
+func (s *fakeSub) Unsubscribe(ctx context.Context) error { return nil }
+
+func (f *fakeWSBackend) Invoke(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	return f.invoke(ctx, result, method, params...)
+}
+
+// Reconnected lazily creates the channel it returns so zero-value fakeWSBackends (most
+// tests never drive a reconnect) don't need to set it up; a test that wants to simulate a
+// reconnect closes the channel this returns.
+func (f *fakeWSBackend) Reconnected() <-chan struct{} {
+	if f.reconnected == nil {
+		f.reconnected = make(chan struct{})
+	}
+	return f.reconnected
+}
+
+func (f *fakeWSBackend) Subscribe(ctx context.Context, notifications chan<- *rpcSubscriptionNotification, method string, params ...interface{}) (rpcSubscription, error) {
+	f.mux.Lock()
+	f.subscribes++
+	f.mux.Unlock()
+	if f.subFails {
+		return nil, assert.AnError
+	}
+	return &fakeSub{id: method}, nil
+}
+
+// httpOnlyBackend implements rpcClient but deliberately does not implement wsSubscriber,
+// mirroring the plain HTTP jsonrpc.Client used outside of WebSocket deployments.
+type httpOnlyBackend struct {
+	invoke func(ctx context.Context, result interface{}, method string, params ...interface{}) error
+}
+
+func (h *httpOnlyBackend) Invoke(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	return h.invoke(ctx, result, method, params...)
+}
+
+// newTestSubscriber builds an eventSubscriber against a channel-backed eventSink, mirroring
+// what EventStreamStart wires up for a caller that supplied an ffcapi.ListenerEvent channel.
+func newTestSubscriber(backend rpcClient, mode deliveryMode, events chan *ffcapi.ListenerEvent, blocks chan *ffcapi.BlockHashEvent) *eventSubscriber {
+	sink, err := newEventSink(context.Background(), events, nil)
+	if err != nil {
+		panic(err)
+	}
+	return newEventSubscriber(context.Background(), backend, mode, sink, newReorgTracker(), blocks)
+}
+
+func TestEventSubscriberAvailableOverWebSocket(t *testing.T) {
+	backend := &fakeWSBackend{}
+	es := newTestSubscriber(backend, deliveryModeAuto, make(chan *ffcapi.ListenerEvent, 1), make(chan *ffcapi.BlockHashEvent, 1))
+	assert.True(t, es.available())
+}
+
+func TestEventSubscriberNotAvailableOverHTTP(t *testing.T) {
+	backend := &httpOnlyBackend{}
+	es := newTestSubscriber(backend, deliveryModeAuto, make(chan *ffcapi.ListenerEvent, 1), make(chan *ffcapi.BlockHashEvent, 1))
+	assert.False(t, es.available())
+
+	// auto mode silently stays on the (unshown) polling path when subscribe isn't available
+	assert.NoError(t, es.start(context.Background()))
+}
+
+func TestEventSubscriberForcedSubscribeFailsWithoutWS(t *testing.T) {
+	backend := &httpOnlyBackend{}
+	es := newTestSubscriber(backend, deliveryModeSubscribe, make(chan *ffcapi.ListenerEvent, 1), make(chan *ffcapi.BlockHashEvent, 1))
+	assert.False(t, es.available())
+
+	err := es.start(context.Background())
+	assert.Regexp(t, "FF23050", err)
+}
+
+func TestEventSubscriberAddListenerBackfillsGap(t *testing.T) {
+	backend := &fakeWSBackend{
+		invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+			assert.Equal(t, "eth_getLogs", method)
+			*result.(*[]*logJSONRPC) = []*logJSONRPC{
+				{BlockNumber: ethtypes.NewHexInteger64(100), TransactionIndex: ethtypes.NewHexInteger64(1), LogIndex: ethtypes.NewHexInteger64(0)},
+			}
+			return nil
+		},
+	}
+	events := make(chan *ffcapi.ListenerEvent, 1)
+	es := newTestSubscriber(backend, deliveryModeAuto, events, make(chan *ffcapi.BlockHashEvent, 1))
+
+	err := es.addListener(context.Background(), "listener1", "0xaddr", "0xtopic0", 90, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, backend.subscribes)
+
+	select {
+	case ev := <-events:
+		assert.Equal(t, int64(100), ev.Checkpoint.(*listenerCheckpoint).Block)
+	default:
+		t.Fatal("expected backfilled event to be delivered")
+	}
+}
+
+func TestEventSubscriberResubscribeAllReestablishesHeadsAndLogs(t *testing.T) {
+	backend := &fakeWSBackend{
+		invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+			switch method {
+			case "eth_blockNumber":
+				*result.(*ethtypes.HexInteger) = *ethtypes.NewHexInteger64(200)
+			case "eth_getLogs":
+				*result.(*[]*logJSONRPC) = []*logJSONRPC{}
+			}
+			return nil
+		},
+	}
+	events := make(chan *ffcapi.ListenerEvent, 1)
+	blocks := make(chan *ffcapi.BlockHashEvent, 1)
+	es := newTestSubscriber(backend, deliveryModeAuto, events, blocks)
+
+	assert.NoError(t, es.addListener(context.Background(), "listener1", "0xaddr", "0xtopic0", 190, 190))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es.ctx = ctx
+	assert.NoError(t, es.start(ctx))
+	subscribesBeforeReconnect := backend.subscribes
+
+	es.resubscribeAll(ctx)
+	// a real reconnect must re-register both the newHeads watch and every listener's "logs"
+	// watch - the node has forgotten both subscription IDs, not just the one that happened
+	// to be used to detect the drop
+	assert.Equal(t, subscribesBeforeReconnect+2, backend.subscribes)
+}
+
+func TestEventSubscriberPumpResubscribesOnReconnectSignal(t *testing.T) {
+	backend := &fakeWSBackend{
+		invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+			switch method {
+			case "eth_blockNumber":
+				*result.(*ethtypes.HexInteger) = *ethtypes.NewHexInteger64(200)
+			case "eth_getLogs":
+				*result.(*[]*logJSONRPC) = []*logJSONRPC{}
+			}
+			return nil
+		},
+	}
+	events := make(chan *ffcapi.ListenerEvent, 1)
+	blocks := make(chan *ffcapi.BlockHashEvent, 1)
+	reconnectSignal := make(chan struct{})
+	backend.reconnected = reconnectSignal // pre-created so the test and pump never race on the lazy-init in Reconnected()
+	es := newTestSubscriber(backend, deliveryModeAuto, events, blocks)
+	assert.NoError(t, es.addListener(context.Background(), "listener1", "0xaddr", "0xtopic0", 190, 190))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es.ctx = ctx
+	assert.NoError(t, es.start(ctx)) // spawns the real pump goroutine under test
+
+	subscribesBeforeReconnect := backend.subscribeCount()
+	close(reconnectSignal)
+
+	// pump - not a direct call to resubscribeAll - must observe the closed channel and
+	// react; poll briefly since it runs on its own goroutine
+	assert.Eventually(t, func() bool {
+		return backend.subscribeCount() >= subscribesBeforeReconnect+2
+	}, time.Second, time.Millisecond)
+}
+
+// TestEventSubscriberInternalDispatcherStreamDeliversLog is the scenario review comment
+// chunk0-4 flagged: a stream started with an InternalDispatcher (no ffcapi.ListenerEvent
+// channel) against a WebSocket-capable backend must not hang the instant a log arrives -
+// es.sink, not a raw nil channel, is what dispatchLog pushes through.
+func TestEventSubscriberInternalDispatcherStreamDeliversLog(t *testing.T) {
+	backend := &fakeWSBackend{
+		invoke: func(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+			if method == "eth_getLogs" {
+				*result.(*[]*logJSONRPC) = []*logJSONRPC{}
+			}
+			return nil
+		},
+	}
+
+	var dispatched []*ffcapi.ListenerEvent
+	dispatcherDone := make(chan struct{}, 1)
+	dispatcher := InternalDispatcher(func(ctx context.Context, events []*ffcapi.ListenerEvent) error {
+		dispatched = append(dispatched, events...)
+		dispatcherDone <- struct{}{}
+		return nil
+	})
+	sink, err := newEventSink(context.Background(), nil, dispatcher)
+	assert.NoError(t, err)
+
+	reorg := newReorgTracker()
+	es := newEventSubscriber(context.Background(), backend, deliveryModeAuto, sink, reorg, make(chan *ffcapi.BlockHashEvent, 1))
+	assert.NoError(t, es.addListener(context.Background(), "listener1", "0xaddr", "0xtopic0", 0, 0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es.ctx = ctx
+	assert.NoError(t, es.start(ctx))
+
+	notification, err := json.Marshal(&rpcSubscriptionNotification{
+		Subscription: "logs",
+		Result:       mustMarshal(t, testLog("0xblock100", 100, 0, 0, false)),
+	})
+	assert.NoError(t, err)
+	var n rpcSubscriptionNotification
+	assert.NoError(t, json.Unmarshal(notification, &n))
+	es.logs <- &n
+
+	select {
+	case <-dispatcherDone:
+	case <-time.After(time.Second):
+		t.Fatal("InternalDispatcher was never invoked - dispatchLog is still blocking on a nil channel")
+	}
+	assert.Len(t, dispatched, 1)
+}
+
+func mustMarshal(t *testing.T, v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestLogToListenerEventNilSafe(t *testing.T) {
+	assert.Nil(t, logToListenerEvent("listener1", nil))
+}
+
+func TestRPCSubscriptionNotificationDecode(t *testing.T) {
+	raw := []byte(`{"subscription":"0x1","result":{"removed":false}}`)
+	var n rpcSubscriptionNotification
+	assert.NoError(t, json.Unmarshal(raw, &n))
+	assert.Equal(t, "0x1", n.Subscription)
+}
@@ -0,0 +1,58 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ethereum
+
+import "github.com/hyperledger/firefly-signer/pkg/ethtypes"
+
+// logJSONRPC is the shape of a single entry returned by eth_getLogs/eth_getFilterChanges/
+// eth_getFilterLogs, and of the "result" object delivered on an eth_subscribe("logs", ...)
+// notification
+type logJSONRPC struct {
+	Removed          bool                      `json:"removed"`
+	LogIndex         *ethtypes.HexInteger      `json:"logIndex"`
+	TransactionIndex *ethtypes.HexInteger      `json:"transactionIndex"`
+	TransactionHash  ethtypes.HexBytes0xPrefix `json:"transactionHash"`
+	BlockHash        ethtypes.HexBytes0xPrefix `json:"blockHash"`
+	BlockNumber      *ethtypes.HexInteger      `json:"blockNumber"`
+	Address          ethtypes.Address0xHex     `json:"address"`
+	Data             ethtypes.HexBytes0xPrefix `json:"data"`
+	Topics           []ethtypes.HexBytes0xPrefix `json:"topics"`
+}
+
+// topic0 returns the first topic (the event signature hash) if present
+func (l *logJSONRPC) topic0() string {
+	if len(l.Topics) == 0 {
+		return ""
+	}
+	return l.Topics[0].String()
+}
+
+// listenerCheckpoint is the persisted resume-point for a single listener: the exact log
+// position (block/transaction/log index) it has processed up to
+type listenerCheckpoint struct {
+	Block            int64 `json:"block"`
+	TransactionIndex int64 `json:"transactionIndex"`
+	LogIndex         int64 `json:"logIndex"`
+}
+
+func checkpointFromLog(l *logJSONRPC) *listenerCheckpoint {
+	return &listenerCheckpoint{
+		Block:            l.BlockNumber.BigInt().Int64(),
+		TransactionIndex: l.TransactionIndex.BigInt().Int64(),
+		LogIndex:         l.LogIndex.BigInt().Int64(),
+	}
+}
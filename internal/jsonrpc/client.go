@@ -0,0 +1,69 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Client is the JSON-RPC transport used by the ethereum package to talk to a node. The
+// plain HTTPClient implementation only supports Invoke; WSClient additionally supports
+// Subscribe, which the ethereum package detects via an interface type assertion rather
+// than a field on this interface, so callers that only need request/response semantics
+// are unaffected by the WebSocket-only capability.
+type Client interface {
+	// Invoke performs a synchronous JSON-RPC call, unmarshalling the result into result
+	Invoke(ctx context.Context, result interface{}, method string, params ...interface{}) error
+}
+
+// rpcRequest is a JSON-RPC 2.0 request envelope, shared by the HTTP and WebSocket clients
+type rpcRequest struct {
+	JSONRpc string        `json:"jsonrpc"`
+	ID      int64         `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params,omitempty"`
+}
+
+// rpcResponse is a JSON-RPC 2.0 response envelope
+type rpcResponse struct {
+	JSONRpc string          `json:"jsonrpc"`
+	ID      int64           `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError is the standard JSON-RPC 2.0 error object
+type rpcError struct {
+	Code    int64  `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcNotification is the envelope used for eth_subscribe push notifications, distinct
+// from a response because it carries a "params" object (subscription + result) rather
+// than an "id"
+type rpcNotification struct {
+	Method string `json:"method"`
+	Params struct {
+		Subscription string          `json:"subscription"`
+		Result       json.RawMessage `json:"result"`
+	} `json:"params"`
+}
@@ -0,0 +1,79 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// HTTPClient is the plain request/response JSON-RPC transport used against nodes
+// accessed over plain HTTP(S). It does not implement Subscribe - eth_subscribe has no
+// meaning without a persistent connection - so the ethereum package's capability check
+// (a type assertion for a Subscribe method) correctly falls back to polling for it.
+type HTTPClient struct {
+	url        string
+	httpClient *http.Client
+	nextID     int64
+}
+
+// NewHTTPClient constructs an HTTP-transport JSON-RPC client against the given node URL
+func NewHTTPClient(url string, httpClient *http.Client) *HTTPClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPClient{url: url, httpClient: httpClient}
+}
+
+func (c *HTTPClient) Invoke(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	id := atomic.AddInt64(&c.nextID, 1)
+	reqBody, err := json.Marshal(&rpcRequest{JSONRpc: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpRes, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+
+	var rpcRes rpcResponse
+	if err := json.NewDecoder(httpRes.Body).Decode(&rpcRes); err != nil {
+		return err
+	}
+	if rpcRes.Error != nil {
+		return rpcRes.Error
+	}
+	if result == nil || len(rpcRes.Result) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(rpcRes.Result, result); err != nil {
+		return fmt.Errorf("failed to unmarshal result of %s: %w", method, err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// errConnectionDropped is the error delivered to every call left pending when the
+// connection backing it is lost and a redial is configured, whether or not that redial
+// succeeds
+var errConnectionDropped = errors.New("websocket connection lost")
+
+// wsConn is the subset of a WebSocket connection the client needs, satisfied by
+// *websocket.Conn (from DialWSClient) and by a fake in tests
+type wsConn interface {
+	WriteJSON(v interface{}) error
+	ReadMessage() (messageType int, p []byte, err error)
+	Close() error
+}
+
+// pendingCall is a synchronous Invoke() waiting for its response to arrive on the read loop
+type pendingCall struct {
+	result interface{}
+	done   chan error
+}
+
+// Subscription is the handle returned by WSClient.Subscribe for a single live
+// eth_subscribe registration
+type Subscription interface {
+	LocalID() string
+	Unsubscribe(ctx context.Context) error
+}
+
+// wsSubscription is the Client-side bookkeeping for one live eth_subscribe registration
+type wsSubscription struct {
+	id            string
+	notifications chan<- *SubscriptionNotification
+	client        *WSClient
+}
+
+func (s *wsSubscription) LocalID() string { return s.id }
+
+func (s *wsSubscription) Unsubscribe(ctx context.Context) error {
+	s.client.Unsubscribe(s.id)
+	var ok bool
+	return s.client.Invoke(ctx, &ok, "eth_unsubscribe", s.id)
+}
+
+// SubscriptionNotification is the params object of an eth_subscription push notification:
+// the node-assigned subscription ID and the raw result. The ethereum package refers to it
+// through its rpcSubscriptionNotification alias.
+type SubscriptionNotification struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+// redialFunc re-establishes the transport connection after the current one drops. Set by
+// DialWSClient to redial the same URL; replaced with a fake in tests that need to drive a
+// reconnect without a real socket.
+type redialFunc func(ctx context.Context) (wsConn, error)
+
+// WSClient is the push-capable JSON-RPC transport used against nodes accessed over a
+// persistent WebSocket connection. Unlike HTTPClient it also implements Subscribe, which
+// the ethereum package's event stream detects via a type assertion to decide whether
+// eth_subscribe push delivery is available for a given stream.
+type WSClient struct {
+	conn   wsConn
+	redial redialFunc
+	nextID int64
+
+	mux         sync.Mutex
+	pending     map[int64]*pendingCall
+	subs        map[string]*wsSubscription // node-assigned subscription ID -> local registration
+	closed      chan struct{}
+	closeErr    error
+	reconnected chan struct{} // closed (and replaced) each time readLoop recovers from a dropped connection
+}
+
+// DialWSClient establishes a WebSocket connection to a node and returns a Client capable
+// of both synchronous Invoke calls and eth_subscribe push delivery. The same URL is
+// redialed automatically if the connection is later lost - see readLoop/reconnect.
+func DialWSClient(ctx context.Context, url string, dialer *websocket.Dialer) (*WSClient, error) {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	redial := func(ctx context.Context) (wsConn, error) {
+		conn, _, err := dialer.DialContext(ctx, url, nil)
+		return conn, err
+	}
+	conn, err := redial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newWSClient(conn, redial), nil
+}
+
+func newWSClient(conn wsConn, redial redialFunc) *WSClient {
+	c := &WSClient{
+		conn:        conn,
+		redial:      redial,
+		pending:     make(map[int64]*pendingCall),
+		subs:        make(map[string]*wsSubscription),
+		closed:      make(chan struct{}),
+		reconnected: make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Reconnected returns a channel that is closed once, the moment a dropped connection is
+// successfully redialed. Callers that need to detect every reconnect (not just the next
+// one) must call Reconnected again after each signal to pick up the channel installed for
+// the following one.
+func (c *WSClient) Reconnected() <-chan struct{} {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.reconnected
+}
+
+func (c *WSClient) Invoke(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	id := atomic.AddInt64(&c.nextID, 1)
+	call := &pendingCall{result: result, done: make(chan error, 1)}
+
+	c.mux.Lock()
+	c.pending[id] = call
+	c.mux.Unlock()
+
+	if err := c.conn.WriteJSON(&rpcRequest{JSONRpc: "2.0", ID: id, Method: method, Params: params}); err != nil {
+		c.mux.Lock()
+		delete(c.pending, id)
+		c.mux.Unlock()
+		return err
+	}
+
+	select {
+	case err := <-call.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return c.closeErr
+	}
+}
+
+// Subscribe issues an eth_subscribe call for the given channel (e.g. "logs", "newHeads")
+// and registers notifications to be delivered on the supplied channel as they arrive on
+// the read loop, until Unsubscribe is called or the connection closes.
+func (c *WSClient) Subscribe(ctx context.Context, notifications chan<- *SubscriptionNotification, method string, params ...interface{}) (Subscription, error) {
+	var subID string
+	callParams := append([]interface{}{method}, params...)
+	if err := c.Invoke(ctx, &subID, "eth_subscribe", callParams...); err != nil {
+		return nil, fmt.Errorf("eth_subscribe(%s) failed: %w", method, err)
+	}
+
+	sub := &wsSubscription{id: subID, notifications: notifications, client: c}
+	c.mux.Lock()
+	c.subs[subID] = sub
+	c.mux.Unlock()
+	return sub, nil
+}
+
+// Unsubscribe removes a subscription's routing entry so its notifications are no longer
+// delivered; it does not itself call eth_unsubscribe, which is the caller's choice (a
+// stream that knows it is about to resubscribe on reconnect can skip the round trip).
+func (c *WSClient) Unsubscribe(subID string) {
+	c.mux.Lock()
+	delete(c.subs, subID)
+	c.mux.Unlock()
+}
+
+// readLoop is the single reader of the WebSocket connection: it demultiplexes incoming
+// frames into synchronous call responses (by id) and subscription notifications (by the
+// "subscription" field). A read error is answered by one redial attempt (see reconnect),
+// which fails every pending Invoke with errConnectionDropped; if no redial is configured or
+// the redial fails, it fails any still-pending Invoke with the read error and gives up
+// permanently, so callers do not hang forever.
+func (c *WSClient) readLoop() {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if c.reconnect() {
+				continue
+			}
+			c.shutdown(err)
+			return
+		}
+
+		var envelope struct {
+			ID     *int64          `json:"id"`
+			Method string          `json:"method"`
+			Result json.RawMessage `json:"result"`
+			Error  *rpcError       `json:"error"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			continue
+		}
+
+		if envelope.ID != nil {
+			c.completeCall(*envelope.ID, envelope.Result, envelope.Error)
+			continue
+		}
+		if envelope.Method == "eth_subscription" {
+			c.deliverNotification(envelope.Params)
+		}
+	}
+}
+
+func (c *WSClient) completeCall(id int64, result json.RawMessage, rpcErr *rpcError) {
+	c.mux.Lock()
+	call := c.pending[id]
+	delete(c.pending, id)
+	c.mux.Unlock()
+	if call == nil {
+		return
+	}
+	if rpcErr != nil {
+		call.done <- rpcErr
+		return
+	}
+	if call.result != nil && len(result) > 0 {
+		call.done <- json.Unmarshal(result, call.result)
+		return
+	}
+	call.done <- nil
+}
+
+func (c *WSClient) deliverNotification(params json.RawMessage) {
+	var n SubscriptionNotification
+	if err := json.Unmarshal(params, &n); err != nil {
+		return
+	}
+	c.mux.Lock()
+	sub := c.subs[n.Subscription]
+	c.mux.Unlock()
+	if sub == nil {
+		return
+	}
+	select {
+	case sub.notifications <- &n:
+	case <-c.closed:
+	}
+}
+
+// reconnect redials the transport after the read loop's connection drops. Every pending
+// Invoke is failed immediately (its response can never arrive on the old socket) and every
+// subscription routing entry is dropped (the node-assigned subscription IDs do not survive
+// across connections - the caller must re-subscribe, which is exactly what the
+// Reconnected() signal below is for). It returns false - telling readLoop to give up and
+// shut down permanently - if no redialFunc was configured (e.g. a fake conn in a test that
+// isn't exercising reconnect) or the redial itself fails.
+func (c *WSClient) reconnect() bool {
+	if c.redial == nil {
+		return false
+	}
+
+	c.mux.Lock()
+	for _, call := range c.pending {
+		call.done <- errConnectionDropped
+	}
+	c.pending = make(map[int64]*pendingCall)
+	c.subs = make(map[string]*wsSubscription)
+	c.mux.Unlock()
+
+	conn, err := c.redial(context.Background())
+	if err != nil {
+		return false
+	}
+
+	c.mux.Lock()
+	c.conn = conn
+	reconnected := c.reconnected
+	c.reconnected = make(chan struct{})
+	c.mux.Unlock()
+	close(reconnected)
+	return true
+}
+
+func (c *WSClient) shutdown(err error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	select {
+	case <-c.closed:
+		return // already shut down
+	default:
+	}
+	c.closeErr = err
+	for _, call := range c.pending {
+		call.done <- err
+	}
+	c.pending = nil
+	close(c.closed)
+}
@@ -0,0 +1,109 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// wsEchoServer accepts real WebSocket connections over an httptest server and answers
+// every request with an empty result, so DialWSClient/Invoke exercise the genuine
+// gorilla/websocket wire protocol rather than a fake wsConn. dropFirstConn, if set, closes
+// exactly one connection (the first) immediately after it is accepted, forcing the
+// client's read loop to observe a real read error and drive a real reconnect.
+type wsEchoServer struct {
+	srv           *httptest.Server
+	dropFirstConn bool
+	conns         int
+}
+
+func newWSEchoServer(dropFirstConn bool) *wsEchoServer {
+	s := &wsEchoServer{dropFirstConn: dropFirstConn}
+	upgrader := websocket.Upgrader{}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		s.conns++
+		if s.conns == 1 && s.dropFirstConn {
+			conn.Close()
+			return
+		}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req rpcRequest
+			if err := json.Unmarshal(data, &req); err != nil {
+				continue
+			}
+			_ = conn.WriteJSON(&rpcResponse{JSONRpc: "2.0", ID: req.ID, Result: json.RawMessage("true")})
+		}
+	}))
+	return s
+}
+
+func (s *wsEchoServer) url() string {
+	return "ws" + strings.TrimPrefix(s.srv.URL, "http")
+}
+
+func (s *wsEchoServer) Close() { s.srv.Close() }
+
+func TestWSClientInvokeOverRealConnection(t *testing.T) {
+	server := newWSEchoServer(false)
+	defer server.Close()
+
+	c, err := DialWSClient(context.Background(), server.url(), nil)
+	assert.NoError(t, err)
+
+	var result bool
+	assert.NoError(t, c.Invoke(context.Background(), &result, "eth_blockNumber"))
+	assert.True(t, result)
+}
+
+func TestWSClientReconnectsAfterRealConnectionDrop(t *testing.T) {
+	server := newWSEchoServer(true)
+	defer server.Close()
+
+	c, err := DialWSClient(context.Background(), server.url(), nil)
+	assert.NoError(t, err)
+
+	reconnected := c.Reconnected()
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for WSClient to redial after the connection was dropped")
+	}
+
+	// the redialed connection must be genuinely live - a call made after the signal must
+	// succeed against the second accepted connection, not hang on the dead first one
+	var result bool
+	assert.NoError(t, c.Invoke(context.Background(), &result, "eth_blockNumber"))
+	assert.True(t, result)
+	assert.Equal(t, 2, server.conns)
+}
@@ -0,0 +1,58 @@
+// Copyright © 2022 Kaleido, Inc.
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msgs
+
+import (
+	"github.com/hyperledger/firefly-common/pkg/i18n"
+	"golang.org/x/text/language"
+)
+
+var ffe = i18n.FFE
+
+var (
+	// MsgInvalidOptions is returned when a listener's Filters or Options JSON cannot be parsed on
+	// EventStreamStart/EventListenerAdd, or when its Options JSON cannot be parsed on EventListenerVerifyOptions
+	MsgInvalidOptions = ffe(language.AmericanEnglish, "FF23033", "Invalid listener options: %s")
+	// MsgInvalidFilter is returned when a listener's Filters JSON cannot be parsed on EventListenerVerifyOptions
+	MsgInvalidFilter = ffe(language.AmericanEnglish, "FF23036", "Invalid filter: %s")
+	// MsgStreamOrListenerNotFound is returned when a stream/listener ID referenced by a request is not registered
+	MsgStreamOrListenerNotFound = ffe(language.AmericanEnglish, "FF23041", "Stream or listener not found: %s")
+	// MsgStreamAlreadyStarted is returned when EventStreamStart is called twice for the same stream ID
+	MsgStreamAlreadyStarted = ffe(language.AmericanEnglish, "FF23042", "Stream '%s' is already started")
+	// MsgStreamStillRunning is returned when EventStreamStopped is called before the stream context has been cancelled
+	MsgStreamStillRunning = ffe(language.AmericanEnglish, "FF23045", "Stream '%s' is still running")
+
+	// MsgWSSubscribeNotSupported is returned when subscribe mode is forced but the backend cannot support it
+	MsgWSSubscribeNotSupported = ffe(language.AmericanEnglish, "FF23050", "Subscribe delivery mode requires a WebSocket JSON-RPC connection")
+	// MsgWSSubscribeFailed wraps a failure to establish an eth_subscribe subscription for a listener,
+	// or for the stream's newHeads subscription
+	MsgWSSubscribeFailed = ffe(language.AmericanEnglish, "FF23051", "Failed to subscribe listener '%s': %s")
+	// MsgWSSubscribeBackfillFailed is returned when the eth_getLogs backfill that catches a newly added
+	// listener up from its checkpoint to the current head could not complete
+	MsgWSSubscribeBackfillFailed = ffe(language.AmericanEnglish, "FF23052", "Failed to backfill listener '%s' from block %d to %d: %s")
+
+	// MsgBadReplayCursor is returned when a EventListenerReplay continuation cursor cannot be parsed
+	MsgBadReplayCursor = ffe(language.AmericanEnglish, "FF23053", "Invalid continuation cursor: %s")
+	// MsgBadReplayBlockRange is returned when FromBlock/ToBlock on a replay request cannot be parsed, or ToBlock precedes FromBlock
+	MsgBadReplayBlockRange = ffe(language.AmericanEnglish, "FF23054", "Invalid replay block range '%s' to '%s': %s")
+	// MsgBadReplayFilter is returned when an EventListenerReplay request's filter cannot be parsed
+	MsgBadReplayFilter = ffe(language.AmericanEnglish, "FF23055", "Invalid replay filter: %s")
+
+	// MsgDispatchModeInvalid is returned when a stream is started with both (or neither of) an
+	// EventStream channel and an InternalDispatcher configured
+	MsgDispatchModeInvalid = ffe(language.AmericanEnglish, "FF23056", "Exactly one of EventStream or InternalDispatcher must be set")
+)